@@ -6,4 +6,5 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/stretchr/testify v1.6.0 // indirect
 	golang.org/x/mod v0.3.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	auditEventAssigned     = "assigned"
+	auditEventReleased     = "released"
+	auditEventVerifyFailed = "verification-failed"
+)
+
+// The outcomes of the assignments.
+const (
+	auditOutcomeAssigned = "assigned"
+	auditOutcomeFailed   = "failed"
+)
+
+// AuditConfig : options for the audit log of GPU assignments.
+type AuditConfig struct {
+	Path string `toml:"path"`
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	ContainerID string    `json:"containerId"`
+	Bundle      string    `json:"bundle,omitempty"`
+	Devices     string    `json:"devices,omitempty"`
+	// Where the device list came from, see getDeviceSource.
+	DeviceSource string   `json:"deviceSource,omitempty"`
+	Capabilities string   `json:"capabilities,omitempty"`
+	Requirements []string `json:"requirements,omitempty"`
+	Privileged   *bool    `json:"privileged,omitempty"`
+	Profile      string   `json:"profile,omitempty"`
+	Outcome      string   `json:"outcome,omitempty"`
+	Reason       string   `json:"reason,omitempty"`
+}
+
+// getAssignmentRecord returns the audit record of the assignment of GPUs to
+// the container, the outcome being left to the caller.
+func getAssignmentRecord(container *containerConfig) auditRecord {
+	privileged := container.Privileged
+	record := auditRecord{
+		Event:        auditEventAssigned,
+		ContainerID:  container.ID,
+		Bundle:       container.Bundle,
+		DeviceSource: container.DeviceSource,
+		Privileged:   &privileged,
+		Profile:      container.Profile,
+	}
+	if container.Nvidia != nil {
+		record.Devices = container.Nvidia.Devices
+		record.Capabilities = container.Nvidia.DriverCapabilities
+		if !container.Nvidia.DisableRequire {
+			record.Requirements = container.Nvidia.Requirements
+		}
+	} else {
+		record.Devices = strings.Join(container.CDIDevices, ",")
+	}
+	return record
+}
+
+// writeAuditRecord appends a record to the audit log, if enabled. Each record
+// is written with a single write to a file opened in append mode, so
+// concurrent hooks do not interleave their records.
+func writeAuditRecord(config AuditConfig, record auditRecord) {
+	if len(config.Path) == 0 {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Println("could not encode audit record:", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		log.Println("could not create audit log directory:", err)
+		return
+	}
+	f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println("could not open audit log:", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Println("could not write audit record:", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetDeviceSource(t *testing.T) {
+	swarm := "DOCKER_RESOURCE_GPU"
+	envSwarmGPU = &swarm
+	defer func() { envSwarmGPU = nil }()
+
+	hook := getDefaultHookConfig()
+	hook.AcceptDeviceListAsVolumeMounts = true
+	mounts := []Mount{{Source: "/dev/null", Destination: deviceListAsVolumeMountsRoot + "/0"}}
+
+	tests := []struct {
+		description string
+		env         map[string]string
+		mounts      []Mount
+		expected    string
+	}{
+		{
+			description: "mounts",
+			env:         map[string]string{envNVVisibleDevices: "1"},
+			mounts:      mounts,
+			expected:    deviceSourceMounts,
+		},
+		{
+			description: "envvar",
+			env:         map[string]string{envNVVisibleDevices: "1", swarm: "2"},
+			expected:    deviceSourceEnv,
+		},
+		{
+			description: "swarm",
+			env:         map[string]string{swarm: "2"},
+			expected:    deviceSourceSwarm,
+		},
+		{
+			description: "legacy image",
+			env:         map[string]string{envCUDAVersion: "10.2"},
+			expected:    deviceSourceLegacyImage,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			if s := getDeviceSource(&hook, tc.env, tc.mounts); s != tc.expected {
+				t.Errorf("Unexpected source %q", s)
+			}
+		})
+	}
+}
+
+func TestAssignmentRecord(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	config := AuditConfig{Path: filepath.Join(tmp, "audit.jsonl")}
+
+	container := containerConfig{
+		ID:           "abcd",
+		Bundle:       "/run/bundle",
+		Privileged:   false,
+		Profile:      "inference",
+		DeviceSource: deviceSourceEnv,
+		Nvidia: &nvidiaConfig{
+			Devices:            "0",
+			DriverCapabilities: "compute,utility",
+			Requirements:       []string{"cuda>=11.0"},
+		},
+	}
+	record := getAssignmentRecord(&container)
+	record.Outcome = auditOutcomeAssigned
+	writeAuditRecord(config, record)
+
+	data, err := ioutil.ReadFile(config.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry auditRecord
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	privileged := false
+	expected := auditRecord{
+		Time:         entry.Time,
+		Event:        auditEventAssigned,
+		ContainerID:  "abcd",
+		Bundle:       "/run/bundle",
+		Devices:      "0",
+		DeviceSource: deviceSourceEnv,
+		Capabilities: "compute,utility",
+		Requirements: []string{"cuda>=11.0"},
+		Privileged:   &privileged,
+		Profile:      "inference",
+		Outcome:      auditOutcomeAssigned,
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Unexpected audit record (got: %+v, wanted: %+v)", entry, expected)
+	}
+
+	// Devices injected by the runtime from annotations.
+	container = containerConfig{
+		ID:           "efgh",
+		DeviceSource: deviceSourceAnnotation,
+		CDIDevices:   []string{"nvidia.com/gpu=0", "nvidia.com/gpu=1"},
+	}
+	if r := getAssignmentRecord(&container); r.Devices != "nvidia.com/gpu=0,nvidia.com/gpu=1" || r.Capabilities != "" {
+		t.Errorf("Unexpected audit record: %+v", r)
+	}
+}
@@ -2,26 +2,179 @@ package main
 
 import (
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-func capabilityToCLI(cap string) string {
-	switch cap {
-	case "compute":
-		return "--compute"
-	case "compat32":
-		return "--compat32"
-	case "graphics":
-		return "--graphics"
-	case "utility":
-		return "--utility"
-	case "video":
-		return "--video"
-	case "display":
-		return "--display"
-	case "ngx":
-		return "--ngx"
-	default:
-		log.Panicln("unknown driver capability:", cap)
-	}
-	return ""
+const (
+	onUnknownCapabilityWarn   = "warn"
+	onUnknownCapabilityReject = "reject"
+)
+
+// DriverCapability : a driver capability and the nvidia-container-cli flag
+// injecting it. A capability requiring devices or files is only available if
+// they all exist under the driver root. Deprecated aliases are still accepted. The
+// verification expects the devices, the files and the libraries (e.g.
+// libcuda.so, looked up in the library directories) in the container.
+type DriverCapability struct {
+	Name              string   `toml:"name"`
+	Flag              string   `toml:"flag"`
+	DeprecatedAliases []string `toml:"deprecated-aliases"`
+	Devices           []string `toml:"devices"`
+	Files             []string `toml:"files"`
+	Libraries         []string `toml:"libraries"`
+}
+
+// CapabilityConfig : driver capabilities added to (or overriding) the
+// built-in ones, and what to do with a requested capability that is unknown
+// or unavailable: "warn" skips it, "reject" fails the container.
+type CapabilityConfig struct {
+	Registry  []DriverCapability `toml:"registry"`
+	OnUnknown string             `toml:"on-unknown"`
+}
+
+// The built-in capabilities, in the order "all" expands to.
+var builtinDriverCapabilities = []DriverCapability{
+	{Name: "compute", Flag: "--compute", Libraries: []string{"libcuda.so"}},
+	{Name: "compat32", Flag: "--compat32"},
+	{Name: "graphics", Flag: "--graphics", Libraries: []string{"libnvidia-glcore.so"}},
+	{Name: "utility", Flag: "--utility", Libraries: []string{"libnvidia-ml.so"}},
+	{Name: "video", Flag: "--video", Libraries: []string{"libnvcuvid.so"}},
+	{Name: "display", Flag: "--display"},
+	{Name: "ngx", Flag: "--ngx", Libraries: []string{"libnvidia-ngx.so"}},
+}
+
+type capabilityRegistry []DriverCapability
+
+// getCapabilityRegistry returns the built-in capabilities, overridden or
+// extended by the configured ones.
+func getCapabilityRegistry(config *CapabilityConfig) capabilityRegistry {
+	registry := append(capabilityRegistry{}, builtinDriverCapabilities...)
+	for _, c := range config.Registry {
+		if len(c.Name) == 0 || len(c.Flag) == 0 {
+			log.Panicln("driver capabilities need a name and a flag:", c)
+		}
+		replaced := false
+		for i := range registry {
+			if registry[i].Name == c.Name {
+				registry[i] = c
+				replaced = true
+			}
+		}
+		if !replaced {
+			registry = append(registry, c)
+		}
+	}
+	return registry
+}
+
+// lookup returns the capability with the given name or deprecated alias.
+func (r capabilityRegistry) lookup(name string) (capability *DriverCapability, deprecated bool) {
+	for i := range r {
+		if r[i].Name == name {
+			return &r[i], false
+		}
+	}
+	for i := range r {
+		if containsString(r[i].DeprecatedAliases, name) {
+			return &r[i], true
+		}
+	}
+	return nil, false
+}
+
+// getMissingRequirements returns the devices and files required by the
+// capability that do not exist under the driver root.
+func (c *DriverCapability) getMissingRequirements(driverRoot string) []string {
+	var missing []string
+	for _, path := range append(append([]string{}, c.Devices...), c.Files...) {
+		if _, err := os.Stat(filepath.Join(driverRoot, path)); err != nil {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+// available returns the capabilities that "all" expands to.
+func (r capabilityRegistry) available(driverRoot string) []DriverCapability {
+	var caps []DriverCapability
+	for i := range r {
+		if len(r[i].getMissingRequirements(driverRoot)) == 0 {
+			caps = append(caps, r[i])
+		}
+	}
+	return caps
+}
+
+func (r capabilityRegistry) all(driverRoot string) string {
+	return getCapabilityNames(r.available(driverRoot))
+}
+
+// resolveDriverCapabilities returns the capabilities of the given list,
+// without duplicates. Unknown and unavailable capabilities are skipped or
+// rejected as configured.
+func resolveDriverCapabilities(config *CapabilityConfig, caps string, driverRoot string) []DriverCapability {
+	registry := getCapabilityRegistry(config)
+
+	skip := func(reason ...interface{}) {
+		switch config.OnUnknown {
+		case onUnknownCapabilityWarn:
+			log.Println(append([]interface{}{"skipping"}, reason...)...)
+		case onUnknownCapabilityReject:
+			deny(deniedReasonCapability, reason...)
+		default:
+			log.Panicln("invalid on-unknown policy for driver capabilities:", config.OnUnknown)
+		}
+	}
+
+	var resolved []DriverCapability
+	for _, name := range strings.Split(caps, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if name == "all" {
+			for _, c := range registry.available(driverRoot) {
+				if !containsCapability(resolved, c.Name) {
+					resolved = append(resolved, c)
+				}
+			}
+			continue
+		}
+
+		capability, deprecated := registry.lookup(name)
+		if capability == nil {
+			skip("unknown driver capability:", name)
+			continue
+		}
+		if deprecated {
+			log.Printf("driver capability %s is deprecated, use %s instead\n", name, capability.Name)
+		}
+		if missing := capability.getMissingRequirements(driverRoot); len(missing) > 0 {
+			skip("unavailable driver capability:", capability.Name, "missing", strings.Join(missing, ", "))
+			continue
+		}
+		if !containsCapability(resolved, capability.Name) {
+			resolved = append(resolved, *capability)
+		}
+	}
+	return resolved
+}
+
+func containsCapability(caps []DriverCapability, name string) bool {
+	for _, c := range caps {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getCapabilityNames(caps []DriverCapability) string {
+	var names []string
+	for _, c := range caps {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ",")
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The capabilities "all" expands to with the default configuration.
+var allDriverCapabilities = getCapabilityRegistry(&CapabilityConfig{}).all("/")
+
+func TestDefaultCapabilityRegistry(t *testing.T) {
+	config := getDefaultHookConfig().DriverCapabilities
+	if all := getCapabilityRegistry(&config).all("/"); all != "compute,compat32,graphics,utility,video,display,ngx" {
+		t.Errorf("Unexpected capabilities for 'all': %v", all)
+	}
+}
+
+func TestResolveDriverCapabilities(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "capabilities-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The devices and files are looked up under the driver root.
+	writeFixture(t, filepath.Join(tmp, "dev/nvidia-fabric"), "")
+
+	registry := []DriverCapability{
+		{Name: "fabric", Flag: "--fabric", Devices: []string{"/dev/nvidia-fabric"}},
+		{Name: "optix", Flag: "--optix", Files: []string{"/usr/lib/libnvoptix.so"}},
+		{Name: "compute", Flag: "--compute", DeprecatedAliases: []string{"cuda"}},
+	}
+
+	tests := []struct {
+		description   string
+		onUnknown     string
+		caps          string
+		expectedFlags []string
+		expectedAll   string
+		expectedPanic bool
+	}{
+		{
+			description:   "Built-in and configured capabilities",
+			onUnknown:     onUnknownCapabilityReject,
+			caps:          "utility,fabric",
+			expectedFlags: []string{"--utility", "--fabric"},
+		},
+		{
+			description:   "Deprecated alias and duplicates",
+			onUnknown:     onUnknownCapabilityReject,
+			caps:          "cuda,compute,utility,",
+			expectedFlags: []string{"--compute", "--utility"},
+		},
+		{
+			description:   "All expands from the registry",
+			onUnknown:     onUnknownCapabilityReject,
+			caps:          "all",
+			expectedFlags: []string{"--compute", "--compat32", "--graphics", "--utility", "--video", "--display", "--ngx", "--fabric"},
+		},
+		{
+			description:   "Unknown capability skipped",
+			onUnknown:     onUnknownCapabilityWarn,
+			caps:          "utility,foo",
+			expectedFlags: []string{"--utility"},
+		},
+		{
+			description:   "Unknown capability rejected",
+			onUnknown:     onUnknownCapabilityReject,
+			caps:          "utility,foo",
+			expectedPanic: true,
+		},
+		{
+			description:   "Unavailable capability skipped",
+			onUnknown:     onUnknownCapabilityWarn,
+			caps:          "optix,utility",
+			expectedFlags: []string{"--utility"},
+		},
+		{
+			description:   "Unavailable capability rejected",
+			onUnknown:     onUnknownCapabilityReject,
+			caps:          "optix",
+			expectedPanic: true,
+		},
+		{
+			description:   "Invalid policy",
+			onUnknown:     "ignore",
+			caps:          "foo",
+			expectedPanic: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			config := CapabilityConfig{Registry: registry, OnUnknown: tc.onUnknown}
+
+			var caps []DriverCapability
+			resolve := func() {
+				caps = resolveDriverCapabilities(&config, tc.caps, tmp)
+			}
+			if tc.expectedPanic {
+				mustPanic(t, resolve)
+				return
+			}
+			resolve()
+
+			var flags []string
+			for _, c := range caps {
+				flags = append(flags, c.Flag)
+			}
+			if !elementsMatch(flags, tc.expectedFlags) || len(flags) != len(tc.expectedFlags) {
+				t.Errorf("Unexpected flags: %v", flags)
+			}
+		})
+	}
+}
+
+func TestCapabilityRegistryOverride(t *testing.T) {
+	config := CapabilityConfig{
+		Registry: []DriverCapability{{Name: "video", Flag: "--video", DeprecatedAliases: []string{"nvenc"}}},
+	}
+	registry := getCapabilityRegistry(&config)
+	if len(registry) != len(builtinDriverCapabilities) {
+		t.Errorf("Expected the built-in capability to be replaced: %v", registry)
+	}
+	if c, deprecated := registry.lookup("nvenc"); c == nil || c.Name != "video" || !deprecated {
+		t.Errorf("Unexpected lookup result: %v", c)
+	}
+
+	mustPanic(t, func() {
+		getCapabilityRegistry(&CapabilityConfig{Registry: []DriverCapability{{Name: "foo"}}})
+	})
+}
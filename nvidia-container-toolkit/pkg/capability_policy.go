@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	capabilityPolicyTrim   = "trim"
+	capabilityPolicyReject = "reject"
+)
+
+// CapabilityPolicy : the driver capabilities allowed (all of them if empty)
+// and denied.
+type CapabilityPolicy struct {
+	Allowed []string `toml:"allowed"`
+	Denied  []string `toml:"denied"`
+}
+
+// CapabilityPolicyConfig : the driver capabilities of privileged and
+// unprivileged containers, and what to do with requests breaking the
+// policies: "trim" removes the offending capabilities, "reject" fails the
+// container. Pools and profiles have policies of their own, a container must
+// satisfy all the policies that apply to it.
+type CapabilityPolicyConfig struct {
+	OnViolation  string           `toml:"on-violation"`
+	Privileged   CapabilityPolicy `toml:"privileged"`
+	Unprivileged CapabilityPolicy `toml:"unprivileged"`
+}
+
+// check returns why the capability breaks the policy, if it does.
+func (p *CapabilityPolicy) check(name string) (bool, string) {
+	if containsString(p.Denied, name) {
+		return false, "denied"
+	}
+	if len(p.Allowed) > 0 && !containsString(p.Allowed, name) {
+		return false, "not allowed"
+	}
+	return true, ""
+}
+
+type namedCapabilityPolicy struct {
+	source string
+	policy *CapabilityPolicy
+}
+
+func getCapabilityPolicies(hook *HookConfig, devices string, privileged bool, profile string) []namedCapabilityPolicy {
+	var policies []namedCapabilityPolicy
+	if privileged {
+		policies = append(policies, namedCapabilityPolicy{"privileged containers", &hook.CapabilityPolicy.Privileged})
+	} else {
+		policies = append(policies, namedCapabilityPolicy{"unprivileged containers", &hook.CapabilityPolicy.Unprivileged})
+	}
+	var inv *Inventory
+	if len(hook.Pools) > 0 {
+		// The inventory is optional, without it devices are matched by index.
+		inv, _ = loadInventory(hook.Inventory)
+	}
+	pools, err := getDevicePools(hook.Pools, devices, inv)
+	if err != nil {
+		deny(deniedReasonCapabilityPolicy, err)
+	}
+	for _, name := range pools {
+		pool := hook.Pools[name]
+		policies = append(policies, namedCapabilityPolicy{"pool " + name, &pool.Capabilities})
+	}
+	if len(profile) > 0 {
+		p := hook.Profiles[profile]
+		policies = append(policies, namedCapabilityPolicy{"profile " + profile, &p.Capabilities})
+	}
+	return policies
+}
+
+// getPolicyViolation returns why the capability breaks one of the policies, if
+// it does.
+func getPolicyViolation(policies []namedCapabilityPolicy, name string) string {
+	for _, p := range policies {
+		if ok, why := p.policy.check(name); !ok {
+			return fmt.Sprintf("%s by the policy for %s", why, p.source)
+		}
+	}
+	return ""
+}
+
+// handlePolicyViolation logs that the capability is removed, or rejects the
+// container, as configured.
+func handlePolicyViolation(hook *HookConfig, name string, reason string) {
+	switch hook.CapabilityPolicy.OnViolation {
+	case capabilityPolicyTrim:
+		log.Printf("removing driver capability %s: %s\n", name, reason)
+	case capabilityPolicyReject:
+		deny(deniedReasonCapabilityPolicy, fmt.Sprintf("driver capability %s is %s", name, reason))
+	default:
+		log.Panicln("invalid on-violation policy for driver capabilities:", hook.CapabilityPolicy.OnViolation)
+	}
+}
+
+// applyCapabilityPolicy resolves the driver capabilities of the container and
+// returns those allowed by all the policies that apply to it.
+func applyCapabilityPolicy(hook *HookConfig, nvidia *nvidiaConfig, privileged bool, profile string) []DriverCapability {
+	policies := getCapabilityPolicies(hook, nvidia.Devices, privileged, profile)
+
+	var allowed []DriverCapability
+	for _, c := range resolveDriverCapabilities(&hook.DriverCapabilities, nvidia.DriverCapabilities, getDriverRoot(hook)) {
+		if reason := getPolicyViolation(policies, c.Name); len(reason) > 0 {
+			handlePolicyViolation(hook, c.Name, reason)
+			continue
+		}
+		allowed = append(allowed, c)
+	}
+	return allowed
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyCapabilityPolicy(t *testing.T) {
+	tests := []struct {
+		description   string
+		onViolation   string
+		devices       string
+		capabilities  string
+		privileged    bool
+		profile       string
+		expected      string
+		expectedPanic bool
+	}{
+		{
+			description:  "Privileged container",
+			onViolation:  capabilityPolicyTrim,
+			devices:      "2",
+			capabilities: "all",
+			privileged:   true,
+			expected:     allDriverCapabilities,
+		},
+		{
+			description:  "Unprivileged container",
+			onViolation:  capabilityPolicyTrim,
+			devices:      "2",
+			capabilities: "all",
+			expected:     "compute,compat32,utility,video,ngx",
+		},
+		{
+			description:  "Pool",
+			onViolation:  capabilityPolicyTrim,
+			devices:      "0:1",
+			capabilities: "compute,utility,video",
+			privileged:   true,
+			expected:     "compute,utility",
+		},
+		{
+			description:  "All devices use all pools",
+			onViolation:  capabilityPolicyTrim,
+			devices:      "all",
+			capabilities: "all",
+			privileged:   true,
+			expected:     "compute,utility",
+		},
+		{
+			description:  "Profile",
+			onViolation:  capabilityPolicyTrim,
+			devices:      "0",
+			capabilities: "compute,utility",
+			privileged:   true,
+			profile:      "inference",
+			expected:     "utility",
+		},
+		{
+			description:   "Rejected",
+			onViolation:   capabilityPolicyReject,
+			devices:       "2",
+			capabilities:  "compute,display",
+			expectedPanic: true,
+		},
+		{
+			description:  "Allowed with reject",
+			onViolation:  capabilityPolicyReject,
+			devices:      "2",
+			capabilities: "compute",
+			expected:     "compute",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			hook := getDefaultHookConfig()
+			hook.CapabilityPolicy = CapabilityPolicyConfig{
+				OnViolation:  tc.onViolation,
+				Unprivileged: CapabilityPolicy{Denied: []string{"graphics", "display"}},
+			}
+			hook.Pools = map[string]PoolConfig{
+				"training": {Devices: []string{"0", "1"}, Capabilities: CapabilityPolicy{Allowed: []string{"compute", "utility"}}},
+			}
+			hook.Profiles = map[string]ProfileConfig{
+				"inference": {Capabilities: CapabilityPolicy{Denied: []string{"compute"}}},
+			}
+			nvidia := nvidiaConfig{Devices: tc.devices, DriverCapabilities: tc.capabilities}
+			if tc.capabilities == "all" {
+				nvidia.DriverCapabilities = allDriverCapabilities
+			}
+
+			var capabilities string
+			apply := func() {
+				capabilities = getCapabilityNames(applyCapabilityPolicy(&hook, &nvidia, tc.privileged, tc.profile))
+			}
+			if tc.expectedPanic {
+				mustPanic(t, apply)
+				return
+			}
+			apply()
+			if capabilities != tc.expected {
+				t.Errorf("Unexpected capabilities: %v", capabilities)
+			}
+		})
+	}
+}
+
+func TestGetDevicePools(t *testing.T) {
+	inv := getTestInventory(t)
+	pools := map[string]PoolConfig{
+		"training":  {Devices: []string{"0"}},
+		"inference": {Devices: []string{"GPU-1"}},
+	}
+
+	tests := []struct {
+		description string
+		devices     string
+		inv         *Inventory
+		expected    []string
+		fail        bool
+	}{
+		{"Index of a pool given by UUID", "1", inv, []string{"inference"}, false},
+		{"UUID of a pool given by index", "GPU-0", inv, []string{"training"}, false},
+		{"MIG UUID of a GPU of a pool", "MIG-GPU-1/0/0", inv, []string{"inference"}, false},
+		{"MIG index of a GPU of a pool", "1:0", inv, []string{"inference"}, false},
+		{"All devices", "all", inv, []string{"inference", "training"}, false},
+		{"Index without inventory", "0", nil, []string{"training"}, false},
+		{"Unknown UUID", "GPU-9", inv, nil, true},
+		{"UUID without inventory", "GPU-0", nil, nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			names, err := getDevicePools(pools, tc.devices, tc.inv)
+			if tc.fail {
+				if err == nil {
+					t.Errorf("Expected an error, got pools %v", names)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("Unexpected pools (got: %v, wanted: %v)", names, tc.expected)
+			}
+		})
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	hook := getDefaultHookConfig()
+	hook.Profiles = map[string]ProfileConfig{"inference": {}}
+
+	if p := getProfile(&hook, nil); p != "" {
+		t.Errorf("Unexpected profile: %v", p)
+	}
+	if p := getProfile(&hook, map[string]string{defaultProfileAnnotation: "inference"}); p != "inference" {
+		t.Errorf("Unexpected profile: %v", p)
+	}
+	if p := getProfile(&hook, map[string]string{defaultProfileAnnotation: "training"}); p != "training" {
+		t.Errorf("Unexpected profile: %v", p)
+	}
+
+	checkProfile(&hook, "")
+	checkProfile(&hook, "inference")
+	mustPanic(t, func() {
+		checkProfile(&hook, "training")
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cdiVersion      = "0.5.0"
+	cdiVendor       = "nvidia.com"
+	cdiClass        = "gpu"
+	cdiKind         = cdiVendor + "/" + cdiClass
+	cdiAllDevices   = "all"
+	cdiFormatYAML   = "yaml"
+	cdiFormatJSON   = "json"
+	cdiSpecBaseName = "nvidia"
+
+	defaultCDIStaticDir  = "/etc/cdi"
+	defaultCDIDynamicDir = "/var/run/cdi"
+)
+
+var validCDIDeviceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:-]*$`)
+
+// The CDI spec types below follow the Container Device Interface specification:
+// https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
+type cdiSpec struct {
+	Version        string             `json:"cdiVersion" yaml:"cdiVersion"`
+	Kind           string             `json:"kind" yaml:"kind"`
+	Devices        []cdiDevice        `json:"devices" yaml:"devices"`
+	ContainerEdits *cdiContainerEdits `json:"containerEdits,omitempty" yaml:"containerEdits,omitempty"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name" yaml:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits" yaml:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string        `json:"env,omitempty" yaml:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty" yaml:"deviceNodes,omitempty"`
+	Hooks       []cdiHook       `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+	Mounts      []cdiMount      `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+}
+
+// cdiDeviceNode : the runtime reads the type and numbers from the host
+// device node when they are not set.
+type cdiDeviceNode struct {
+	Path        string `json:"path" yaml:"path"`
+	HostPath    string `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+	Type        string `json:"type,omitempty" yaml:"type,omitempty"`
+	Major       int64  `json:"major,omitempty" yaml:"major,omitempty"`
+	Minor       int64  `json:"minor,omitempty" yaml:"minor,omitempty"`
+	Permissions string `json:"permissions,omitempty" yaml:"permissions,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath" yaml:"hostPath"`
+	ContainerPath string   `json:"containerPath" yaml:"containerPath"`
+	Type          string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Options       []string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+type cdiHook struct {
+	HookName string   `json:"hookName" yaml:"hookName"`
+	Path     string   `json:"path" yaml:"path"`
+	Args     []string `json:"args,omitempty" yaml:"args,omitempty"`
+	Env      []string `json:"env,omitempty" yaml:"env,omitempty"`
+	Timeout  *int     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+func getCDIDeviceNodes(devices []InventoryDevice) []cdiDeviceNode {
+	var nodes []cdiDeviceNode
+	for _, d := range devices {
+		node := cdiDeviceNode{Path: d.Path}
+		if d.Major != nil && d.Minor != nil {
+			node.Type = "c"
+			node.Major = *d.Major
+			node.Minor = *d.Minor
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// getCDIDeviceNames returns the names of a device: its index and, when it
+// is a valid CDI device name, its UUID.
+func getCDIDeviceNames(index string, uuid string) []string {
+	names := []string{index}
+	if len(uuid) > 0 && validCDIDeviceName.MatchString(uuid) {
+		names = append(names, uuid)
+	}
+	return names
+}
+
+// generateCDISpec describes the GPUs, the MIG devices and all the GPUs of the
+// inventory. The control devices, driver files, environment and hooks needed
+// by the given capabilities are common to all of them.
+func generateCDISpec(inv *Inventory, caps []string) *cdiSpec {
+	spec := cdiSpec{
+		Version: cdiVersion,
+		Kind:    cdiKind,
+	}
+
+	var all []InventoryDevice
+	for _, gpu := range inv.GPUs {
+		all = append(all, gpu.Devices...)
+		for _, name := range getCDIDeviceNames(strconv.Itoa(gpu.Index), gpu.UUID) {
+			spec.Devices = append(spec.Devices, cdiDevice{
+				Name:           name,
+				ContainerEdits: cdiContainerEdits{DeviceNodes: getCDIDeviceNodes(gpu.Devices)},
+			})
+		}
+		for _, mig := range gpu.MIG {
+			nodes := getCDIDeviceNodes(append(append([]InventoryDevice{}, gpu.Devices...), mig.Devices...))
+			for _, name := range getCDIDeviceNames(fmt.Sprintf("%d:%d", gpu.Index, mig.Index), mig.UUID) {
+				spec.Devices = append(spec.Devices, cdiDevice{
+					Name:           name,
+					ContainerEdits: cdiContainerEdits{DeviceNodes: nodes},
+				})
+			}
+		}
+	}
+	spec.Devices = append(spec.Devices, cdiDevice{
+		Name:           cdiAllDevices,
+		ContainerEdits: cdiContainerEdits{DeviceNodes: getCDIDeviceNodes(all)},
+	})
+
+	edits := cdiContainerEdits{Env: inv.Env}
+	var control []InventoryDevice
+	for _, d := range inv.ControlDevices {
+		if hasAnyCapability(d.Capabilities, caps) {
+			control = append(control, d)
+		}
+	}
+	edits.DeviceNodes = getCDIDeviceNodes(control)
+	for _, f := range inv.getFiles(caps) {
+		edits.Mounts = append(edits.Mounts, cdiMount{
+			HostPath:      f.Path,
+			ContainerPath: f.getContainerPath(),
+			Options:       driverFileMountOptions,
+		})
+	}
+	for _, h := range inv.getHooks(caps) {
+		edits.Hooks = append(edits.Hooks, cdiHook{
+			HookName: h.HookName,
+			Path:     h.Path,
+			Args:     h.Args,
+			Env:      h.Env,
+			Timeout:  h.Timeout,
+		})
+	}
+	spec.ContainerEdits = &edits
+
+	return &spec
+}
+
+func encodeCDISpec(spec *cdiSpec, format string) ([]byte, error) {
+	switch format {
+	case cdiFormatYAML:
+		return yaml.Marshal(spec)
+	case cdiFormatJSON:
+		data, err := json.MarshalIndent(spec, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+	return nil, fmt.Errorf("unknown CDI spec format %q", format)
+}
+
+// writeCDISpec atomically writes a CDI spec, so that runtimes watching the
+// CDI directories never see a partial file.
+func writeCDISpec(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+func doCDIGenerate(args []string) {
+	hook := getHookConfig()
+
+	var format, output, capabilities string
+	flags := flag.NewFlagSet("cdi generate", flag.ExitOnError)
+	inventory := flags.String("inventory", hook.Inventory, "inventory of the NVIDIA devices and driver files")
+	flags.StringVar(&format, "format", cdiFormatYAML, "output format: 'yaml' or 'json'")
+	flags.StringVar(&output, "output", "", fmt.Sprintf("output file, '-' for stdout (default: %s/%s.FORMAT)", defaultCDIStaticDir, cdiSpecBaseName))
+	flags.StringVar(&capabilities, "capabilities", getCapabilityRegistry(&hook.DriverCapabilities).all(getDriverRoot(&hook)), "driver capabilities to inject")
+	flags.Parse(args)
+
+	inv, err := loadInventory(*inventory)
+	if err != nil {
+		log.Panicln(err)
+	}
+	data, err := encodeCDISpec(generateCDISpec(inv, strings.Split(capabilities, ",")), format)
+	if err != nil {
+		log.Panicln("could not generate CDI spec:", err)
+	}
+
+	if output == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+	if len(output) == 0 {
+		output = filepath.Join(defaultCDIStaticDir, cdiSpecBaseName+"."+format)
+	}
+	if err := writeCDISpec(output, data); err != nil {
+		log.Panicln("could not write CDI spec:", err)
+	}
+}
+
+func doCDI(args []string) {
+	defer exit()
+	log.SetFlags(0)
+
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s cdi generate [-inventory FILE] [-format yaml|json] [-output FILE] [-capabilities LIST]\n", os.Args[0])
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "generate":
+		doCDIGenerate(args[1:])
+	default:
+		log.Panicln("unknown cdi command:", args[0])
+	}
+}
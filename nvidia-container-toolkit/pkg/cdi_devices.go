@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// Annotations requesting CDI devices, as set by e.g. Kubernetes device plugins.
+	cdiAnnotationPrefix = "cdi.k8s.io/"
+)
+
+// A fully qualified CDI device name: vendor.com/class=name
+var cdiDeviceNamePattern = regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9.-]*)/([a-zA-Z0-9][a-zA-Z0-9_.-]*)=([a-zA-Z0-9][a-zA-Z0-9_.:-]*)$`)
+
+func isCDIDevice(name string) bool {
+	return cdiDeviceNamePattern.MatchString(name)
+}
+
+// splitCDIDevices separates the CDI device names from the other entries of a
+// device list.
+func splitCDIDevices(devices string) (cdi []string, others []string) {
+	for _, d := range splitDeviceList(devices) {
+		if isCDIDevice(d) {
+			cdi = append(cdi, d)
+		} else {
+			others = append(others, d)
+		}
+	}
+	return cdi, others
+}
+
+func getCDIDevicesFromAnnotations(annotations map[string]string) []string {
+	var keys []string
+	for k := range annotations {
+		if strings.HasPrefix(k, cdiAnnotationPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var devices []string
+	for _, k := range keys {
+		devices = append(devices, splitDeviceList(annotations[k])...)
+	}
+	return devices
+}
+
+// cdiRegistry indexes the devices of the CDI specs by fully qualified name.
+type cdiRegistry struct {
+	devices map[string]*cdiDevice
+	specs   map[string]*cdiSpec
+}
+
+// loadCDISpecs reads the CDI specs of the given directories. As with other
+// CDI implementations, a device defined in a later directory takes
+// precedence over one defined in an earlier directory.
+func loadCDISpecs(dirs []string) (*cdiRegistry, error) {
+	registry := &cdiRegistry{
+		devices: make(map[string]*cdiDevice),
+		specs:   make(map[string]*cdiSpec),
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			ext := filepath.Ext(f.Name())
+			if f.IsDir() || (ext != ".yaml" && ext != ".json") {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			// YAML is a superset of JSON.
+			var spec cdiSpec
+			if err := yaml.Unmarshal(data, &spec); err != nil {
+				return nil, fmt.Errorf("could not decode CDI spec %s: %v", path, err)
+			}
+			for i := range spec.Devices {
+				name := spec.Kind + "=" + spec.Devices[i].Name
+				registry.devices[name] = &spec.Devices[i]
+				registry.specs[name] = &spec
+			}
+		}
+	}
+	return registry, nil
+}
+
+// resolve returns the container edits of the given devices, including the
+// common edits of their specs (once per spec).
+func (r *cdiRegistry) resolve(names []string) ([]cdiContainerEdits, error) {
+	var edits []cdiContainerEdits
+	seen := make(map[*cdiSpec]bool)
+	seenDevices := make(map[string]bool)
+	for _, name := range names {
+		if seenDevices[name] {
+			continue
+		}
+		seenDevices[name] = true
+
+		device, ok := r.devices[name]
+		if !ok {
+			return nil, fmt.Errorf("unresolvable CDI device %q", name)
+		}
+		spec := r.specs[name]
+		if !seen[spec] {
+			seen[spec] = true
+			if spec.ContainerEdits != nil {
+				edits = append(edits, *spec.ContainerEdits)
+			}
+		}
+		edits = append(edits, device.ContainerEdits)
+	}
+	return edits, nil
+}
+
+func applyCDIEdits(spec *Spec, edits cdiContainerEdits) error {
+	for _, e := range edits.Env {
+		p := strings.SplitN(e, "=", 2)
+		if len(p) != 2 {
+			return fmt.Errorf("invalid environment variable in CDI spec: %q", e)
+		}
+		spec.Process.Env = setEnv(spec.Process.Env, p[0], p[1])
+	}
+
+	for _, n := range edits.DeviceNodes {
+		if len(n.Type) > 0 && n.Type != "c" {
+			return fmt.Errorf("unsupported type %q of CDI device node %s", n.Type, n.Path)
+		}
+		host := InventoryDevice{Path: n.HostPath}
+		if len(host.Path) == 0 {
+			host.Path = n.Path
+		}
+		if n.Type == "c" {
+			host.Major, host.Minor = &n.Major, &n.Minor
+		}
+		major, minor, err := host.getNumbers()
+		if err != nil {
+			return err
+		}
+		access := n.Permissions
+		if len(access) == 0 {
+			access = "rwm"
+		}
+		addLinuxDevice(spec, n.Path, major, minor, access)
+	}
+
+	for _, m := range edits.Mounts {
+		if hasMount(spec.Mounts, m.ContainerPath) {
+			continue
+		}
+		mountType := m.Type
+		if len(mountType) == 0 {
+			mountType = "bind"
+		}
+		spec.Mounts = append(spec.Mounts, Mount{
+			Destination: m.ContainerPath,
+			Type:        mountType,
+			Source:      m.HostPath,
+			Options:     m.Options,
+		})
+	}
+
+	for _, h := range edits.Hooks {
+		if !addHook(spec, h.HookName, Hook{Path: h.Path, Args: h.Args, Env: h.Env, Timeout: h.Timeout}) {
+			return fmt.Errorf("unknown hook stage %q in CDI spec", h.HookName)
+		}
+	}
+	return nil
+}
+
+// removeCDIDevices removes the CDI device names from the device lists of the
+// spec, so that the hook only sees the devices left for it to inject.
+func removeCDIDevices(hook *HookConfig, spec *Spec) {
+	envVars := []string{envNVVisibleDevices}
+	if envSwarmGPU != nil {
+		envVars = append(envVars, *envSwarmGPU)
+	}
+	env := getEnvMap(spec.Process.Env)
+	for _, envVar := range envVars {
+		devices, ok := env[envVar]
+		if !ok {
+			continue
+		}
+		cdi, others := splitCDIDevices(devices)
+		if len(cdi) == 0 {
+			continue
+		}
+		if len(others) == 0 {
+			spec.Process.Env = setEnv(spec.Process.Env, envVar, "void")
+		} else {
+			spec.Process.Env = setEnv(spec.Process.Env, envVar, strings.Join(others, ","))
+		}
+	}
+
+	if !hook.AcceptDeviceListAsVolumeMounts {
+		return
+	}
+	var mounts []Mount
+	for _, m := range spec.Mounts {
+		if devices := getDevicesFromMounts([]Mount{m}); devices != nil && isCDIDevice(*devices) {
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+	spec.Mounts = mounts
+}
+
+// getCDIGPUDevices returns the device list of our devices among the given CDI
+// devices, e.g. "0,GPU-1" for nvidia.com/gpu=0 and nvidia.com/gpu=GPU-1.
+func getCDIGPUDevices(names []string) string {
+	var devices []string
+	for _, name := range names {
+		if strings.HasPrefix(name, cdiKind+"=") {
+			devices = append(devices, strings.TrimPrefix(name, cdiKind+"="))
+		}
+	}
+	return strings.Join(devices, ",")
+}
+
+// trimCDIEdits removes the control devices, driver files and hooks of the
+// inventory that are only needed by capabilities not in caps, returning the
+// capabilities of the removed entries. Entries the inventory does not know
+// about are kept.
+func (inv *Inventory) trimCDIEdits(edits cdiContainerEdits, caps []string) (cdiContainerEdits, []string) {
+	var removed []string
+	keep := func(capabilities []string) bool {
+		if hasAnyCapability(capabilities, caps) {
+			return true
+		}
+		removed = append(removed, capabilities...)
+		return false
+	}
+
+	trimmed := cdiContainerEdits{Env: edits.Env}
+	for _, n := range edits.DeviceNodes {
+		path := n.HostPath
+		if len(path) == 0 {
+			path = n.Path
+		}
+		if d, ok := inv.lookupControlDevice(path); ok && !keep(d.Capabilities) {
+			continue
+		}
+		trimmed.DeviceNodes = append(trimmed.DeviceNodes, n)
+	}
+	for _, m := range edits.Mounts {
+		if f, ok := inv.lookupFile(m.HostPath); ok && !keep(f.Capabilities) {
+			continue
+		}
+		trimmed.Mounts = append(trimmed.Mounts, m)
+	}
+	for _, h := range edits.Hooks {
+		if ih, ok := inv.lookupHook(h.Path, h.Args); ok && !keep(ih.Capabilities) {
+			continue
+		}
+		trimmed.Hooks = append(trimmed.Hooks, h)
+	}
+	return trimmed, removed
+}
+
+// applyCDICapabilityPolicy removes from the edits of the CDI devices what only
+// serves the driver capabilities that the policies of the container, of its
+// pools and of its profile do not allow, or rejects the container, as
+// configured.
+func applyCDICapabilityPolicy(hook *HookConfig, edits []cdiContainerEdits, devices string, privileged bool, profile string) ([]cdiContainerEdits, error) {
+	policies := getCapabilityPolicies(hook, devices, privileged, profile)
+	var allowed []string
+	violations := make(map[string]string)
+	for _, c := range getCapabilityRegistry(&hook.DriverCapabilities) {
+		if reason := getPolicyViolation(policies, c.Name); len(reason) > 0 {
+			violations[c.Name] = reason
+		} else {
+			allowed = append(allowed, c.Name)
+		}
+	}
+	if len(violations) == 0 {
+		return edits, nil
+	}
+
+	// The CDI specs do not say which capabilities their edits are for, the
+	// inventory they were generated from does.
+	inv, err := loadInventory(hook.Inventory)
+	if err != nil {
+		return nil, fmt.Errorf("cannot apply the driver capability policies to CDI devices: %v", err)
+	}
+	var trimmed []cdiContainerEdits
+	removed := make(map[string]bool)
+	for _, e := range edits {
+		t, caps := inv.trimCDIEdits(e, allowed)
+		for _, c := range caps {
+			removed[c] = true
+		}
+		trimmed = append(trimmed, t)
+	}
+	var names []string
+	for c := range removed {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	for _, c := range names {
+		if reason, ok := violations[c]; ok {
+			handlePolicyViolation(hook, c, reason)
+		}
+	}
+	return trimmed, nil
+}
+
+// injectCDIDevices applies the edits of the CDI devices requested through
+// the device list or the CDI annotations of the container. It returns false
+// if the container does not request any CDI devices.
+//
+// As with the device list, unprivileged containers may only request devices
+// through annotations if allowed to, and the profile and capability policies
+// apply to the devices requested.
+func injectCDIDevices(hook *HookConfig, spec *Spec) (bool, error) {
+	envSwarmGPU = hook.SwarmResource
+	names := getCDIDevicesFromAnnotations(spec.Annotations)
+
+	env := getEnvMap(spec.Process.Env)
+	privileged := getPrivilegeDecision(&hook.Privilege, spec).Privileged
+	if len(names) > 0 && !privileged && !hook.AcceptCDIAnnotationsUnprivileged {
+		deny(deniedReasonPrivileges, "insufficient privileges to request CDI devices through annotations")
+	}
+	if devices := getDevices(hook, env, spec.Mounts, privileged, false); devices != nil {
+		cdi, _ := splitCDIDevices(*devices)
+		names = append(names, cdi...)
+	}
+	if len(names) == 0 {
+		return false, nil
+	}
+	profile := getProfile(hook, spec.Annotations)
+	checkProfile(hook, profile)
+
+	registry, err := loadCDISpecs(hook.CDISpecDirs)
+	if err != nil {
+		return false, fmt.Errorf("could not load CDI specs: %v", err)
+	}
+	edits, err := registry.resolve(names)
+	if err != nil {
+		return false, err
+	}
+	edits, err = applyCDICapabilityPolicy(hook, edits, getCDIGPUDevices(names), privileged, profile)
+	if err != nil {
+		return false, err
+	}
+
+	removeCDIDevices(hook, spec)
+	for _, e := range edits {
+		if err := applyCDIEdits(spec, e); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
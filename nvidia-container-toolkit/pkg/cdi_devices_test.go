@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCDIDevices(t *testing.T) {
+	cdi, others := splitCDIDevices("0,nvidia.com/gpu=1, GPU-abcd ,nvidia.com/gpu=all,vendor/invalid")
+	if !reflect.DeepEqual(cdi, []string{"nvidia.com/gpu=1", "nvidia.com/gpu=all"}) {
+		t.Errorf("Unexpected CDI devices: %v", cdi)
+	}
+	if !reflect.DeepEqual(others, []string{"0", "GPU-abcd", "vendor/invalid"}) {
+		t.Errorf("Unexpected other devices: %v", others)
+	}
+}
+
+func writeTestCDISpec(t *testing.T, dir string, name string, spec *cdiSpec, format string) {
+	data, err := encodeCDISpec(spec, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInjectCDIDevices(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cdi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	static := filepath.Join(tmp, "etc")
+	dynamic := filepath.Join(tmp, "run")
+	for _, dir := range []string{static, dynamic} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inv := getTestInventory(t)
+	writeTestCDISpec(t, static, "nvidia.yaml", generateCDISpec(inv, []string{"utility"}), cdiFormatYAML)
+
+	// A device of a later directory takes precedence.
+	major, minor := int64(195), int64(7)
+	override := &cdiSpec{
+		Version: cdiVersion,
+		Kind:    cdiKind,
+		Devices: []cdiDevice{{
+			Name: "0",
+			ContainerEdits: cdiContainerEdits{
+				DeviceNodes: []cdiDeviceNode{{Path: "/dev/nvidia7", Type: "c", Major: major, Minor: minor}},
+			},
+		}},
+	}
+	writeTestCDISpec(t, dynamic, "override.json", override, cdiFormatJSON)
+
+	hook := getDefaultHookConfig()
+	hook.CDISpecDirs = []string{static, filepath.Join(tmp, "missing"), dynamic}
+
+	tests := []struct {
+		description       string
+		env               []string
+		annotations       map[string]string
+		acceptAnnotations bool
+		modified          bool
+		devices           []string
+		visible           string
+		fail              bool
+		denied            bool
+	}{
+		{
+			description: "No CDI devices",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=0"},
+			visible:     "0",
+		},
+		{
+			description: "CDI device in envvar",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=1"},
+			modified:    true,
+			devices:     []string{"/dev/nvidiactl", "/dev/nvidia1"},
+			visible:     "void",
+		},
+		{
+			description: "CDI and legacy devices in envvar",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=1:0,0"},
+			modified:    true,
+			devices:     []string{"/dev/nvidiactl", "/dev/nvidia1", "/dev/nvidia-caps/nvidia-cap12"},
+			visible:     "0",
+		},
+		{
+			description:       "CDI device in annotation",
+			annotations:       map[string]string{"cdi.k8s.io/gpu": "nvidia.com/gpu=0"},
+			acceptAnnotations: true,
+			modified:          true,
+			devices:           []string{"/dev/nvidia7"},
+		},
+		{
+			description: "CDI device in annotation of an unprivileged container",
+			annotations: map[string]string{"cdi.k8s.io/gpu": "nvidia.com/gpu=all"},
+			denied:      true,
+		},
+		{
+			description: "Unresolvable CDI device",
+			env:         []string{"NVIDIA_VISIBLE_DEVICES=nvidia.com/gpu=5"},
+			fail:        true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			spec := getTestSpec(tc.env)
+			spec.Annotations = tc.annotations
+			hook.AcceptCDIAnnotationsUnprivileged = tc.acceptAnnotations
+
+			if tc.denied {
+				mustPanic(t, func() {
+					injectCDIDevices(&hook, spec)
+				})
+				if spec.Linux != nil {
+					t.Error("Expected the spec to be left untouched")
+				}
+				return
+			}
+			modified, err := injectCDIDevices(&hook, spec)
+			if tc.fail {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if modified != tc.modified {
+				t.Fatalf("Expected modified to be %v", tc.modified)
+			}
+			if modified && !reflect.DeepEqual(getDevicePaths(spec), tc.devices) {
+				t.Errorf("Unexpected devices: %v", getDevicePaths(spec))
+			}
+			if visible := getEnvMap(spec.Process.Env)[envNVVisibleDevices]; visible != tc.visible {
+				t.Errorf("Unexpected %s: %q", envNVVisibleDevices, visible)
+			}
+
+			// Applying the annotations again leaves the spec as it is.
+			if len(tc.annotations) > 0 {
+				edited, _ := json.Marshal(spec)
+				if _, err := injectCDIDevices(&hook, spec); err != nil {
+					t.Fatal(err)
+				}
+				if again, _ := json.Marshal(spec); string(again) != string(edited) {
+					t.Errorf("Injecting the devices again changed the spec: %s", again)
+				}
+			}
+		})
+	}
+}
+
+func TestInjectCDIDevicesPolicies(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cdi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	inv := getTestInventory(t)
+	writeTestCDISpec(t, tmp, "nvidia.yaml", generateCDISpec(inv, []string{"compute", "utility"}), cdiFormatYAML)
+
+	hook := getDefaultHookConfig()
+	hook.CDISpecDirs = []string{tmp}
+	hook.Inventory = filepath.Join(tmp, "inventory.toml")
+	hook.Pools = map[string]PoolConfig{"inference": {Devices: []string{"0"}, Capabilities: CapabilityPolicy{Allowed: []string{"utility"}}}}
+	hook.Profiles = map[string]ProfileConfig{"training": {}}
+
+	tests := []struct {
+		description string
+		devices     string
+		profile     string
+		onViolation string
+		mounts      []string
+		nodes       []string
+		denied      bool
+	}{
+		{
+			description: "Device outside of the pool",
+			devices:     "nvidia.com/gpu=1",
+			onViolation: capabilityPolicyTrim,
+			mounts:      []string{"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02", "/usr/lib/x86_64-linux-gnu/libcuda.so.450.80.02", "/usr/local/bin/nvidia-smi"},
+			nodes:       []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia1"},
+		},
+		{
+			description: "Compute trimmed by the pool",
+			devices:     "nvidia.com/gpu=0",
+			onViolation: capabilityPolicyTrim,
+			mounts:      []string{"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02", "/usr/local/bin/nvidia-smi"},
+			nodes:       []string{"/dev/nvidiactl", "/dev/nvidia0"},
+		},
+		{
+			description: "Compute rejected by the pool",
+			devices:     "nvidia.com/gpu=0",
+			onViolation: capabilityPolicyReject,
+			denied:      true,
+		},
+		{
+			description: "Known profile",
+			devices:     "nvidia.com/gpu=1",
+			profile:     "training",
+			onViolation: capabilityPolicyReject,
+			mounts:      []string{"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02", "/usr/lib/x86_64-linux-gnu/libcuda.so.450.80.02", "/usr/local/bin/nvidia-smi"},
+			nodes:       []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia1"},
+		},
+		{
+			description: "Unknown profile",
+			devices:     "nvidia.com/gpu=1",
+			profile:     "inference",
+			onViolation: capabilityPolicyTrim,
+			denied:      true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			// The inventory is only needed when a policy applies.
+			os.Remove(hook.Inventory)
+			if strings.Contains(tc.devices, "=0") {
+				if err := ioutil.WriteFile(hook.Inventory, []byte(testInventory), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hook.CapabilityPolicy.OnViolation = tc.onViolation
+			spec := getTestSpec([]string{envNVVisibleDevices + "=" + tc.devices})
+			if len(tc.profile) > 0 {
+				spec.Annotations = map[string]string{defaultProfileAnnotation: tc.profile}
+			}
+
+			if tc.denied {
+				mustPanic(t, func() {
+					injectCDIDevices(&hook, spec)
+				})
+				return
+			}
+			if _, err := injectCDIDevices(&hook, spec); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(getMountDestinations(spec), tc.mounts) {
+				t.Errorf("Unexpected mounts: %v", getMountDestinations(spec))
+			}
+			if !reflect.DeepEqual(getDevicePaths(spec), tc.nodes) {
+				t.Errorf("Unexpected devices: %v", getDevicePaths(spec))
+			}
+		})
+	}
+}
+
+func TestRemoveCDIDevicesFromMounts(t *testing.T) {
+	hook := getDefaultHookConfig()
+	hook.AcceptDeviceListAsVolumeMounts = true
+
+	spec := getTestSpec(nil)
+	spec.Mounts = []Mount{
+		{Source: "/dev/null", Destination: filepath.Join(deviceListAsVolumeMountsRoot, "nvidia.com/gpu=0")},
+		{Source: "/dev/null", Destination: filepath.Join(deviceListAsVolumeMountsRoot, "1")},
+	}
+	removeCDIDevices(&hook, spec)
+	if devices := getDevicesFromMounts(spec.Mounts); devices == nil || *devices != "1" {
+		t.Errorf("Unexpected devices left in mounts: %v", spec.Mounts)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func getCDIDevice(spec *cdiSpec, name string) *cdiDevice {
+	for i := range spec.Devices {
+		if spec.Devices[i].Name == name {
+			return &spec.Devices[i]
+		}
+	}
+	return nil
+}
+
+func getCDINodePaths(nodes []cdiDeviceNode) (paths []string) {
+	for _, n := range nodes {
+		paths = append(paths, n.Path)
+	}
+	return paths
+}
+
+func TestGenerateCDISpec(t *testing.T) {
+	inv := getTestInventory(t)
+	spec := generateCDISpec(inv, []string{"utility"})
+
+	var names []string
+	for _, d := range spec.Devices {
+		names = append(names, d.Name)
+	}
+	expectedNames := []string{"0", "GPU-0", "1", "GPU-1", "1:0", "all"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Unexpected device names: %v", names)
+	}
+
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"0", []string{"/dev/nvidia0"}},
+		{"GPU-1", []string{"/dev/nvidia1"}},
+		{"1:0", []string{"/dev/nvidia1", "/dev/nvidia-caps/nvidia-cap12"}},
+		{"all", []string{"/dev/nvidia0", "/dev/nvidia1"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := getCDIDevice(spec, tc.name)
+			if d == nil {
+				t.Fatal("Device not found")
+			}
+			if paths := getCDINodePaths(d.ContainerEdits.DeviceNodes); !reflect.DeepEqual(paths, tc.expected) {
+				t.Errorf("Unexpected device nodes: %v", paths)
+			}
+		})
+	}
+
+	node := getCDIDevice(spec, "0").ContainerEdits.DeviceNodes[0]
+	if node.Type != "c" || node.Major != 195 || node.Minor != 0 {
+		t.Errorf("Unexpected device node: %+v", node)
+	}
+
+	edits := spec.ContainerEdits
+	if paths := getCDINodePaths(edits.DeviceNodes); !reflect.DeepEqual(paths, []string{"/dev/nvidiactl"}) {
+		t.Errorf("Unexpected common device nodes: %v", paths)
+	}
+	var mounts []string
+	for _, m := range edits.Mounts {
+		mounts = append(mounts, m.HostPath+":"+m.ContainerPath)
+	}
+	expectedMounts := []string{
+		"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02:/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02",
+		"/usr/bin/nvidia-smi:/usr/local/bin/nvidia-smi",
+	}
+	if !reflect.DeepEqual(mounts, expectedMounts) {
+		t.Errorf("Unexpected mounts: %v", mounts)
+	}
+	if len(edits.Hooks) != 0 {
+		t.Errorf("Unexpected hooks: %v", edits.Hooks)
+	}
+	if !reflect.DeepEqual(edits.Env, []string{"NVIDIA_DRIVER_VERSION=450.80.02"}) {
+		t.Errorf("Unexpected environment: %v", edits.Env)
+	}
+
+	spec = generateCDISpec(inv, []string{"compute"})
+	if len(spec.ContainerEdits.Hooks) != 1 || spec.ContainerEdits.Hooks[0].HookName != "createContainer" {
+		t.Errorf("Unexpected hooks: %v", spec.ContainerEdits.Hooks)
+	}
+}
+
+func TestEncodeCDISpec(t *testing.T) {
+	spec := generateCDISpec(getTestInventory(t), []string{"compute", "utility"})
+
+	data, err := encodeCDISpec(spec, cdiFormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "cdiVersion: "+cdiVersion+"\nkind: nvidia.com/gpu\n") {
+		t.Errorf("Unexpected YAML spec:\n%s", data)
+	}
+	var fromYAML cdiSpec
+	if err := yaml.Unmarshal(data, &fromYAML); err != nil || !reflect.DeepEqual(&fromYAML, spec) {
+		t.Errorf("YAML spec does not round-trip: %v", err)
+	}
+
+	data, err = encodeCDISpec(spec, cdiFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON cdiSpec
+	if err := json.Unmarshal(data, &fromJSON); err != nil || !reflect.DeepEqual(&fromJSON, spec) {
+		t.Errorf("JSON spec does not round-trip: %v", err)
+	}
+
+	if _, err := encodeCDISpec(spec, "xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CUDA images ship the libraries of a newer driver in /usr/local/cuda/compat,
+// which let a CUDA version newer than the host driver supports run on the
+// host driver: https://docs.nvidia.com/deploy/cuda-compatibility/
+const (
+	cudaCompatDir        = "/usr/local/cuda/compat"
+	cudaCompatLdconfPath = "/etc/ld.so.conf.d/000_cuda_compat.conf"
+)
+
+// The minimum host driver version the compat libraries of each CUDA major
+// version work with.
+var cudaCompatMinimumDrivers = map[int]string{
+	10: "384.111",
+	11: "418.40.04",
+	12: "470.57.02",
+}
+
+// cudaCompat : the forward-compatibility libraries of an image.
+type cudaCompat struct {
+	LibCUDAPath    string
+	LibCUDAVersion string
+	CUDAVersion    string
+}
+
+// getImageCUDAVersion returns the "major.minor" CUDA version of the image,
+// from CUDA_VERSION or else from the highest cuda>= constraint of its
+// requirements.
+func getImageCUDAVersion(env map[string]string, requirements []string) string {
+	if _, err := parseVersion(env[envCUDAVersion]); err == nil {
+		vmaj, vmin, _ := parseCudaVersion(env[envCUDAVersion])
+		return fmt.Sprintf("%d.%d", vmaj, vmin)
+	}
+
+	var version []int
+	for _, raw := range requirements {
+		r, err := parseRequirement(raw)
+		if err != nil {
+			continue
+		}
+		for _, group := range r.Groups {
+			for _, c := range group {
+				if c.Key != requirementCUDA || (c.Operator != ">=" && c.Operator != ">") {
+					continue
+				}
+				v, _ := parseVersion(c.Value)
+				if compareVersions(v, version) > 0 {
+					version = v
+				}
+			}
+		}
+	}
+	if version == nil {
+		return ""
+	}
+	parts := make([]string, len(version))
+	for i, n := range version {
+		parts[i] = fmt.Sprint(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// resolveInRootfs resolves the symlinks of the path as they would be in the
+// container, absolute links being relative to the rootfs (e.g. /usr/local/cuda
+// links to /usr/local/cuda-11.0 or /etc/alternatives/cuda).
+func resolveInRootfs(rootfs string, path string) (string, error) {
+	var resolved string
+	remaining := strings.Split(strings.Trim(path, "/"), "/")
+	for links := 0; len(remaining) > 0; {
+		name := remaining[0]
+		remaining = remaining[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = append(strings.Split(strings.Trim(target, "/"), "/"), remaining...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// findCUDACompat returns the compat libraries of the image, if any.
+func findCUDACompat(rootfs string) *cudaCompat {
+	dir, err := resolveInRootfs(rootfs, cudaCompatDir)
+	if err != nil {
+		return nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "libcuda.so.*"))
+	for _, m := range matches {
+		if v := libcudaPattern.FindStringSubmatch(filepath.Base(m)); v != nil {
+			return &cudaCompat{
+				LibCUDAPath:    m,
+				LibCUDAVersion: v[1],
+				CUDAVersion:    getCUDAVersion(v[1]),
+			}
+		}
+	}
+	return nil
+}
+
+// checkCUDACompat tells whether the compat libraries can run the CUDA version
+// of the image on the host driver.
+func checkCUDACompat(compat *cudaCompat, imageCUDA string, driverVersion string) error {
+	compatDriver, err := parseVersion(compat.LibCUDAVersion)
+	if err != nil {
+		return err
+	}
+	driver, err := parseVersion(driverVersion)
+	if err != nil {
+		return err
+	}
+	cuda, _ := parseVersion(compat.CUDAVersion)
+	image, _ := parseVersion(imageCUDA)
+
+	if compareVersions(cuda, image) < 0 {
+		return fmt.Errorf("the compat libraries of the image (%s) only support CUDA %s", compat.LibCUDAVersion, orUnknown(compat.CUDAVersion))
+	}
+	if compareVersions(compatDriver, driver) <= 0 {
+		return fmt.Errorf("the compat libraries of the image (%s) are not newer than the host driver", compat.LibCUDAVersion)
+	}
+	min, ok := cudaCompatMinimumDrivers[cuda[0]]
+	if !ok {
+		return fmt.Errorf("no forward compatibility for CUDA %s", compat.CUDAVersion)
+	}
+	if v, _ := parseVersion(min); compareVersions(driver, v) < 0 {
+		return fmt.Errorf("the compat libraries of CUDA %d need driver >= %s", cuda[0], min)
+	}
+	return nil
+}
+
+// getCUDACompat returns the compat libraries to use when the image needs a
+// newer CUDA version than the host driver supports, or nil if they are not
+// needed (or the versions are unknown). It fails when the image cannot run on
+// the host driver.
+func getCUDACompat(rootfs string, env map[string]string, requirements []string, facts *hostFacts) (*cudaCompat, error) {
+	imageCUDA := getImageCUDAVersion(env, requirements)
+	if len(imageCUDA) == 0 || len(facts.CUDAVersion) == 0 || len(facts.DriverVersion) == 0 {
+		return nil, nil
+	}
+	image, _ := parseVersion(imageCUDA)
+	host, _ := parseVersion(facts.CUDAVersion)
+	if compareVersions(image, host) <= 0 {
+		return nil, nil
+	}
+
+	insufficient := fmt.Sprintf("the image needs CUDA %s but the host driver %s only supports CUDA %s", imageCUDA, facts.DriverVersion, facts.CUDAVersion)
+	compat := findCUDACompat(rootfs)
+	if compat == nil {
+		return nil, fmt.Errorf("%s, and the image has no forward-compatibility libraries in %s: upgrade the driver or use an older image", insufficient, cudaCompatDir)
+	}
+	if len(compat.CUDAVersion) == 0 {
+		// Compat libraries of a driver branch newer than we know about, which
+		// we cannot check.
+		return nil, nil
+	}
+	if err := checkCUDACompat(compat, imageCUDA, facts.DriverVersion); err != nil {
+		return nil, fmt.Errorf("%s, and %v: upgrade the driver or use an older image", insufficient, err)
+	}
+	return compat, nil
+}
+
+// enableCUDACompat puts the compat libraries first in the library search
+// path of the container, before nvidia-container-cli runs ldconfig. The path
+// is under the control of the image, symlinks are not followed so that the
+// file cannot land outside of the rootfs.
+func enableCUDACompat(rootfs string) error {
+	dir := rootfs
+	for _, name := range strings.Split(strings.Trim(filepath.Dir(cudaCompatLdconfPath), "/"), "/") {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+
+	path := filepath.Join(rootfs, cudaCompatLdconfPath)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(cudaCompatDir + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
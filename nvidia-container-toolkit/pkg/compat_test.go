@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetImageCUDAVersion(t *testing.T) {
+	tests := []struct {
+		description  string
+		env          map[string]string
+		requirements []string
+		expected     string
+	}{
+		{
+			description: "CUDA_VERSION",
+			env:         map[string]string{envCUDAVersion: "12.2.0"},
+			expected:    "12.2",
+		},
+		{
+			description:  "requirement",
+			requirements: []string{"cuda>=11.4 brand=tesla,driver>=418,driver<419 cuda>=11.8"},
+			expected:     "11.8",
+		},
+		{
+			description:  "invalid CUDA_VERSION",
+			env:          map[string]string{envCUDAVersion: "latest"},
+			requirements: []string{"cuda>=11.0"},
+			expected:     "11.0",
+		},
+		{
+			description:  "unknown",
+			requirements: []string{"driver>=450"},
+			expected:     "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			if v := getImageCUDAVersion(tc.env, tc.requirements); v != tc.expected {
+				t.Errorf("Unexpected CUDA version %q", v)
+			}
+		})
+	}
+}
+
+func TestGetCUDACompat(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "compat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	writeFixture(t, filepath.Join(rootfs, "usr/local/cuda-12.2/compat/libcuda.so.535.54.03"), "")
+	if err := os.Symlink("/usr/local/cuda-12.2", filepath.Join(rootfs, "usr/local/cuda")); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{envCUDAVersion: "12.2.0"}
+
+	tests := []struct {
+		description string
+		facts       hostFacts
+		expectNil   bool
+		expectError string
+	}{
+		{
+			description: "host driver recent enough",
+			facts:       hostFacts{DriverVersion: "535.104.05", CUDAVersion: "12.2"},
+			expectNil:   true,
+		},
+		{
+			description: "compat libraries",
+			facts:       hostFacts{DriverVersion: "470.82.01", CUDAVersion: "11.4"},
+		},
+		{
+			description: "host driver too old",
+			facts:       hostFacts{DriverVersion: "450.80.02", CUDAVersion: "11.0"},
+			expectError: "need driver >= 470.57.02",
+		},
+		{
+			description: "unknown host driver",
+			facts:       hostFacts{},
+			expectNil:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			compat, err := getCUDACompat(rootfs, env, nil, &tc.facts)
+			if len(tc.expectError) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.expectNil != (compat == nil) {
+				t.Fatalf("Unexpected compat libraries: %+v", compat)
+			}
+			if compat != nil && (compat.LibCUDAVersion != "535.54.03" || compat.CUDAVersion != "12.2") {
+				t.Errorf("Unexpected compat libraries: %+v", compat)
+			}
+		})
+	}
+
+	os.RemoveAll(filepath.Join(rootfs, "usr"))
+	_, err = getCUDACompat(rootfs, env, nil, &hostFacts{DriverVersion: "470.82.01", CUDAVersion: "11.4"})
+	if err == nil || !strings.Contains(err.Error(), "no forward-compatibility libraries") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestEnableCUDACompat(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "compat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	if err := enableCUDACompat(rootfs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, cudaCompatLdconfPath))
+	if err != nil || string(data) != cudaCompatDir+"\n" {
+		t.Errorf("Unexpected ld.so.conf: %q, %v", data, err)
+	}
+
+	// The image cannot redirect the file outside of the rootfs.
+	outside, err := ioutil.TempDir("", "compat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	os.RemoveAll(filepath.Join(rootfs, "etc/ld.so.conf.d"))
+	if err := os.Symlink(outside, filepath.Join(rootfs, "etc/ld.so.conf.d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := enableCUDACompat(rootfs); err == nil {
+		t.Error("Expected an error")
+	}
+	if _, err := os.Stat(filepath.Join(outside, filepath.Base(cudaCompatLdconfPath))); !os.IsNotExist(err) {
+		t.Error("Unexpected file outside of the rootfs")
+	}
+}
+
+func TestGetCUDACompatUnknownVersions(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "compat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+
+	writeFixture(t, filepath.Join(rootfs, "usr/local/cuda/compat/libcuda.so.570.86.15"), "")
+	env := map[string]string{envCUDAVersion: "12.8.0"}
+
+	// Versions we cannot tell are left to nvidia-container-cli, rather than
+	// denied.
+	tests := []struct {
+		description string
+		facts       hostFacts
+	}{
+		{
+			description: "compat libraries of a newer driver branch",
+			facts:       hostFacts{DriverVersion: "535.104.05", CUDAVersion: getCUDAVersion("535.104.05")},
+		},
+		{
+			description: "host driver of a newer driver branch",
+			facts:       hostFacts{DriverVersion: "570.86.15", CUDAVersion: getCUDAVersion("570.86.15")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			compat, err := getCUDACompat(rootfs, env, nil, &tc.facts)
+			if err != nil || compat != nil {
+				t.Errorf("Unexpected compat libraries: %+v, %v", compat, err)
+			}
+		})
+	}
+}
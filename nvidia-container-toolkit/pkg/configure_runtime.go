@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	runtimeContainerd = "containerd"
+	runtimeDocker     = "docker"
+	runtimeCRIO       = "crio"
+
+	configureModeRuntime = "runtime"
+	configureModeHook    = "hook"
+
+	defaultRuntimeName = "nvidia"
+	defaultRuntimePath = "/usr/bin/" + runtimeBinaryName
+
+	defaultContainerdConfig = "/etc/containerd/config.toml"
+	defaultDockerConfig     = "/etc/docker/daemon.json"
+	defaultCRIODropIn       = "/etc/crio/crio.conf.d/99-nvidia.conf"
+	defaultCRIOHooksDConfig = "/usr/share/containers/oci/hooks.d/oci-nvidia-hook.json"
+
+	containerdRuncV2 = "io.containerd.runc.v2"
+)
+
+type runtimeConfigOptions struct {
+	Runtime      string
+	Mode         string
+	RuntimeName  string
+	RuntimePath  string
+	HookPath     string
+	SetAsDefault bool
+}
+
+func getDefaultRuntimeConfigPath(opts *runtimeConfigOptions) (string, error) {
+	switch opts.Runtime {
+	case runtimeContainerd:
+		return defaultContainerdConfig, nil
+	case runtimeDocker:
+		return defaultDockerConfig, nil
+	case runtimeCRIO:
+		if opts.Mode == configureModeHook {
+			return defaultCRIOHooksDConfig, nil
+		}
+		return defaultCRIODropIn, nil
+	}
+	return "", fmt.Errorf("unknown runtime %q", opts.Runtime)
+}
+
+// getTable returns the nested TOML table (or JSON object) at the given keys,
+// creating the missing ones.
+func getTable(m map[string]interface{}, keys ...string) (map[string]interface{}, error) {
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			t := make(map[string]interface{})
+			m[k] = t
+			m = t
+			continue
+		}
+		t, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not a table", k)
+		}
+		m = t
+	}
+	return m, nil
+}
+
+// copyValue deep-copies a decoded TOML or JSON value.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = copyValue(e)
+		}
+		return c
+	case []map[string]interface{}:
+		c := make([]map[string]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyValue(e).(map[string]interface{})
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyValue(e)
+		}
+		return c
+	}
+	return v
+}
+
+// configureContainerd registers the runtime in a containerd configuration.
+// The runtime starts as a copy of the runc runtime, so that its options (e.g.
+// SystemdCgroup) are kept. Settings are kept but, as the file is re-encoded,
+// comments are not.
+func configureContainerd(config []byte, opts *runtimeConfigOptions) ([]byte, error) {
+	c := make(map[string]interface{})
+	if _, err := toml.Decode(string(config), &c); err != nil {
+		return nil, err
+	}
+
+	// containerd 1.3+ reads the version 2 schema, a file without a version
+	// uses the version 1 schema. New files use the version 2 schema.
+	criPlugin := "cri"
+	if len(bytes.TrimSpace(config)) == 0 {
+		c["version"] = int64(2)
+	}
+	if version, ok := c["version"].(int64); ok && version == 2 {
+		criPlugin = "io.containerd.grpc.v1.cri"
+	}
+
+	containerd, err := getTable(c, "plugins", criPlugin, "containerd")
+	if err != nil {
+		return nil, err
+	}
+	runtimes, err := getTable(containerd, "runtimes")
+	if err != nil {
+		return nil, err
+	}
+
+	runtime, ok := copyValue(runtimes["runc"]).(map[string]interface{})
+	if !ok {
+		runtime = map[string]interface{}{"runtime_type": containerdRuncV2}
+	}
+	options, err := getTable(runtime, "options")
+	if err != nil {
+		return nil, err
+	}
+	options["BinaryName"] = opts.RuntimePath
+	runtimes[opts.RuntimeName] = runtime
+
+	if opts.SetAsDefault {
+		containerd["default_runtime_name"] = opts.RuntimeName
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// configureDocker registers the runtime in a Docker daemon.json.
+func configureDocker(config []byte, opts *runtimeConfigOptions) ([]byte, error) {
+	c := make(map[string]interface{})
+	if len(bytes.TrimSpace(config)) > 0 {
+		v, err := decodeJSONValue(config)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if c, ok = v.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("not a JSON object")
+		}
+	}
+
+	runtimes, err := getTable(c, "runtimes")
+	if err != nil {
+		return nil, err
+	}
+	runtimes[opts.RuntimeName] = map[string]interface{}{
+		"path":        opts.RuntimePath,
+		"runtimeArgs": []interface{}{},
+	}
+	if opts.SetAsDefault {
+		c["default-runtime"] = opts.RuntimeName
+	}
+
+	data, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// configureCRIO registers the runtime in a CRI-O drop-in file, or generates
+// the hooks.d configuration of the hook in hook mode.
+func configureCRIO(config []byte, opts *runtimeConfigOptions) ([]byte, error) {
+	if opts.Mode == configureModeHook {
+		return generateHookConfig(&hookConfigOptions{
+			Format:   hookFormatHooksD,
+			HookPath: opts.HookPath,
+			PathEnv:  strings.Join(defaultPATH, ":"),
+		})
+	}
+
+	c := make(map[string]interface{})
+	if _, err := toml.Decode(string(config), &c); err != nil {
+		return nil, err
+	}
+	crio, err := getTable(c, "crio", "runtime")
+	if err != nil {
+		return nil, err
+	}
+	runtime, err := getTable(crio, "runtimes", opts.RuntimeName)
+	if err != nil {
+		return nil, err
+	}
+	runtime["runtime_path"] = opts.RuntimePath
+	runtime["runtime_type"] = "oci"
+	if opts.SetAsDefault {
+		crio["default_runtime"] = opts.RuntimeName
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func configureRuntime(config []byte, opts *runtimeConfigOptions) ([]byte, error) {
+	switch opts.Mode {
+	case configureModeRuntime:
+	case configureModeHook:
+		// Only CRI-O (like podman) picks up hooks by itself.
+		if opts.Runtime != runtimeCRIO {
+			return nil, fmt.Errorf("%s does not support hooks, configure the runtime instead", opts.Runtime)
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q", opts.Mode)
+	}
+
+	switch opts.Runtime {
+	case runtimeContainerd:
+		return configureContainerd(config, opts)
+	case runtimeDocker:
+		return configureDocker(config, opts)
+	case runtimeCRIO:
+		return configureCRIO(config, opts)
+	}
+	return nil, fmt.Errorf("unknown runtime %q", opts.Runtime)
+}
+
+// getLineDiff returns a diff of the two texts in the unified diff format, as
+// a single hunk with all the lines, or nothing if they are the same.
+func getLineDiff(path string, a string, b string) string {
+	if a == b {
+		return ""
+	}
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// Longest common subsequence of the lines.
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "--- %s\n+++ %s\n@@ -%s +%s @@\n", path, path, getHunkRange(len(x)), getHunkRange(len(y)))
+	line := func(prefix string, l string) {
+		diff.WriteString(prefix + l)
+		if !strings.HasSuffix(l, "\n") {
+			diff.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			line(" ", x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", x[i])
+			i++
+		default:
+			line("+", y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		line("-", x[i])
+	}
+	for ; j < len(y); j++ {
+		line("+", y[j])
+	}
+	return diff.String()
+}
+
+// splitLines returns the lines of the text, with their line endings.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// getHunkRange returns the range of a hunk covering a whole file of the given
+// number of lines.
+func getHunkRange(lines int) string {
+	if lines == 0 {
+		return "0,0"
+	}
+	return fmt.Sprintf("1,%d", lines)
+}
+
+func doConfigureRuntime(args []string) {
+	defer exit()
+	log.SetFlags(0)
+
+	var opts runtimeConfigOptions
+	var config string
+	var dryRun bool
+
+	flags := flag.NewFlagSet("configure-runtime", flag.ExitOnError)
+	flags.StringVar(&opts.Runtime, "runtime", runtimeDocker, "runtime to configure: 'containerd', 'docker' or 'crio'")
+	flags.StringVar(&opts.Mode, "mode", configureModeRuntime, "register the nvidia 'runtime' or, for CRI-O, the 'hook'")
+	flags.StringVar(&opts.RuntimeName, "runtime-name", defaultRuntimeName, "name of the runtime")
+	flags.StringVar(&opts.RuntimePath, "runtime-path", defaultRuntimePath, "path of the runtime binary")
+	flags.StringVar(&opts.HookPath, "hook-path", defaultHookPath, "path of the hook binary")
+	flags.BoolVar(&opts.SetAsDefault, "set-as-default", false, "make the runtime the default runtime")
+	flags.StringVar(&config, "config", "", "configuration file (default: the one of the runtime)")
+	flags.BoolVar(&dryRun, "dry-run", false, "print the changes instead of writing them")
+	flags.Parse(args)
+
+	if len(config) == 0 {
+		var err error
+		if config, err = getDefaultRuntimeConfigPath(&opts); err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	mode := os.FileMode(0644)
+	original, err := ioutil.ReadFile(config)
+	if err != nil && !os.IsNotExist(err) {
+		log.Panicln("could not read configuration:", err)
+	}
+	if info, err := os.Stat(config); err == nil {
+		mode = info.Mode()
+	}
+
+	updated, err := configureRuntime(original, &opts)
+	if err != nil {
+		log.Panicf("could not configure %s: %v\n", opts.Runtime, err)
+	}
+
+	if dryRun {
+		fmt.Print(getLineDiff(config, string(original), string(updated)))
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(config), 0755); err != nil {
+		log.Panicln("could not create configuration directory:", err)
+	}
+	if err := writeFileAtomic(config, updated, mode); err != nil {
+		log.Panicln("could not write configuration:", err)
+	}
+	log.Printf("updated %s, restart %s to apply the changes\n", config, opts.Runtime)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestConfigureContainerd(t *testing.T) {
+	const (
+		v1Config = `
+[plugins.cri]
+  sandbox_image = "k8s.gcr.io/pause:3.2"
+[plugins.cri.containerd.runtimes.runc]
+  runtime_type = "io.containerd.runc.v2"
+  [plugins.cri.containerd.runtimes.runc.options]
+    SystemdCgroup = true
+`
+		v2Config = `
+version = 2
+root = "/var/lib/containerd"
+[plugins."io.containerd.grpc.v1.cri".containerd]
+  default_runtime_name = "runc"
+`
+	)
+
+	tests := []struct {
+		description  string
+		config       string
+		setAsDefault bool
+		plugin       string
+		systemd      bool
+		defaultName  string
+	}{
+		{"Version 1 schema", v1Config, false, "cri", true, ""},
+		{"Version 2 schema", v2Config, true, "io.containerd.grpc.v1.cri", false, "nvidia"},
+		{"New file", "", false, "io.containerd.grpc.v1.cri", false, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			opts := runtimeConfigOptions{
+				Runtime:      runtimeContainerd,
+				Mode:         configureModeRuntime,
+				RuntimeName:  "nvidia",
+				RuntimePath:  defaultRuntimePath,
+				SetAsDefault: tc.setAsDefault,
+			}
+			updated, err := configureRuntime([]byte(tc.config), &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := make(map[string]interface{})
+			if _, err := toml.Decode(string(updated), &c); err != nil {
+				t.Fatalf("Invalid configuration: %v\n%s", err, updated)
+			}
+			containerd, _ := getTable(c, "plugins", tc.plugin, "containerd")
+			runtime, _ := getTable(containerd, "runtimes", "nvidia")
+			options, _ := getTable(runtime, "options")
+			if runtime["runtime_type"] != containerdRuncV2 || options["BinaryName"] != defaultRuntimePath {
+				t.Errorf("Unexpected runtime: %v", runtime)
+			}
+			if systemd, _ := options["SystemdCgroup"].(bool); systemd != tc.systemd {
+				t.Errorf("Unexpected runc options: %v", options)
+			}
+			if name, _ := containerd["default_runtime_name"].(string); tc.defaultName != "" && name != tc.defaultName {
+				t.Errorf("Unexpected default runtime: %v", name)
+			}
+
+			// Other settings are kept.
+			if strings.Contains(tc.config, "sandbox_image") && !strings.Contains(string(updated), `sandbox_image = "k8s.gcr.io/pause:3.2"`) {
+				t.Errorf("Settings were lost:\n%s", updated)
+			}
+			if strings.Contains(tc.config, "root") && c["root"] != "/var/lib/containerd" {
+				t.Errorf("Settings were lost:\n%s", updated)
+			}
+			if tc.config == v2Config && !tc.setAsDefault && containerd["default_runtime_name"] != "runc" {
+				t.Errorf("Default runtime was changed:\n%s", updated)
+			}
+			runc, _ := getTable(containerd, "runtimes", "runc")
+			if tc.systemd && runc["options"].(map[string]interface{})["BinaryName"] != nil {
+				t.Errorf("The runc runtime was modified: %v", runc)
+			}
+		})
+	}
+}
+
+func TestConfigureDocker(t *testing.T) {
+	config := `{"log-driver": "json-file", "max-concurrent-downloads": 10, "runtimes": {"custom": {"path": "/usr/bin/custom"}}}`
+	opts := runtimeConfigOptions{
+		Runtime:      runtimeDocker,
+		Mode:         configureModeRuntime,
+		RuntimeName:  "nvidia",
+		RuntimePath:  defaultRuntimePath,
+		SetAsDefault: true,
+	}
+	updated, err := configureRuntime([]byte(config), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c struct {
+		LogDriver      string      `json:"log-driver"`
+		MaxDownloads   json.Number `json:"max-concurrent-downloads"`
+		DefaultRuntime string      `json:"default-runtime"`
+		Runtimes       map[string]struct {
+			Path string `json:"path"`
+		} `json:"runtimes"`
+	}
+	if err := json.Unmarshal(updated, &c); err != nil {
+		t.Fatalf("Invalid configuration: %v\n%s", err, updated)
+	}
+	if c.LogDriver != "json-file" || c.MaxDownloads != "10" || c.Runtimes["custom"].Path != "/usr/bin/custom" {
+		t.Errorf("Settings were lost:\n%s", updated)
+	}
+	if c.DefaultRuntime != "nvidia" || c.Runtimes["nvidia"].Path != defaultRuntimePath {
+		t.Errorf("Runtime was not configured:\n%s", updated)
+	}
+
+	if _, err := configureRuntime([]byte("[]"), &opts); err == nil {
+		t.Error("Expected an error for a configuration that is not an object")
+	}
+}
+
+func TestConfigureCRIO(t *testing.T) {
+	opts := runtimeConfigOptions{
+		Runtime:      runtimeCRIO,
+		Mode:         configureModeRuntime,
+		RuntimeName:  "nvidia",
+		RuntimePath:  defaultRuntimePath,
+		HookPath:     defaultHookPath,
+		SetAsDefault: true,
+	}
+	updated, err := configureRuntime([]byte("[crio.runtime]\nselinux = true\n"), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c struct {
+		CRIO struct {
+			Runtime struct {
+				SELinux        bool   `toml:"selinux"`
+				DefaultRuntime string `toml:"default_runtime"`
+				Runtimes       map[string]struct {
+					RuntimePath string `toml:"runtime_path"`
+				} `toml:"runtimes"`
+			} `toml:"runtime"`
+		} `toml:"crio"`
+	}
+	if _, err := toml.Decode(string(updated), &c); err != nil {
+		t.Fatalf("Invalid configuration: %v\n%s", err, updated)
+	}
+	r := c.CRIO.Runtime
+	if !r.SELinux || r.DefaultRuntime != "nvidia" || r.Runtimes["nvidia"].RuntimePath != defaultRuntimePath {
+		t.Errorf("Unexpected configuration:\n%s", updated)
+	}
+
+	opts.Mode = configureModeHook
+	updated, err = configureRuntime(nil, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hooksD hooksDConfig
+	if err := json.Unmarshal(updated, &hooksD); err != nil || hooksD.Hook.Path != defaultHookPath {
+		t.Errorf("Unexpected hooks.d configuration: %v\n%s", err, updated)
+	}
+
+	opts.Runtime = runtimeDocker
+	if _, err := configureRuntime(nil, &opts); err == nil {
+		t.Error("Expected an error for hook mode with Docker")
+	}
+}
+
+func TestGetLineDiff(t *testing.T) {
+	tests := []struct {
+		description string
+		a           string
+		b           string
+		expected    string
+	}{
+		{"Changed lines", "a\nb\nc\n", "a\nc\nd\n", "--- config\n+++ config\n@@ -1,3 +1,3 @@\n a\n-b\n c\n+d\n"},
+		{"New file", "", "a\n", "--- config\n+++ config\n@@ -0,0 +1,1 @@\n+a\n"},
+		{"No newline at end of file", "a", "a\nb\n", "--- config\n+++ config\n@@ -1,1 +1,2 @@\n-a\n\\ No newline at end of file\n+a\n+b\n"},
+		{"Same text", "a\n", "a\n", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			if diff := getLineDiff("config", tc.a, tc.b); diff != tc.expected {
+				t.Errorf("Unexpected diff:\n%s", diff)
+			}
+		})
+	}
+}
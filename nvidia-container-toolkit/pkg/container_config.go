@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -27,7 +29,6 @@ const (
 )
 
 const (
-	allDriverCapabilities     = "compute,compat32,graphics,utility,video,display,ngx"
 	defaultDriverCapabilities = "utility"
 )
 
@@ -35,6 +36,11 @@ const (
 	capSysAdmin = "CAP_SYS_ADMIN"
 )
 
+const (
+	minSpecVersion = "v1.0.0-rc1"
+	maxSpecVersion = "v1.2"
+)
+
 const (
 	deviceListAsVolumeMountsRoot = "/var/run/nvidia-container-devices"
 )
@@ -46,24 +52,50 @@ type nvidiaConfig struct {
 	DriverCapabilities string
 	Requirements       []string
 	DisableRequire     bool
+	// Capabilities are the DriverCapabilities resolved against the registry,
+	// once the capability policies are applied.
+	Capabilities []DriverCapability
 }
 
 type containerConfig struct {
-	Pid    int
-	Rootfs string
-	Env    map[string]string
-	Nvidia *nvidiaConfig
+	ID            string
+	Pid           int
+	Bundle        string
+	Rootfs        string
+	Env           map[string]string
+	UserNamespace bool
+	UIDMappings   []LinuxIDMapping
+	GIDMappings   []LinuxIDMapping
+	Privileged    bool
+	Profile       string
+	DeviceSource  string
+	// CDIDevices are the devices requested through annotations, which the
+	// runtime injects.
+	CDIDevices []string
+	Nvidia     *nvidiaConfig
 }
 
 // Root from OCI runtime spec
 // github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L94-L100
 type Root struct {
-	Path string `json:"path"`
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// User from OCI runtime spec
+// github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L96-L108
+type User struct {
+	UID            uint32   `json:"uid" platform:"linux,solaris"`
+	GID            uint32   `json:"gid" platform:"linux,solaris"`
+	Umask          *uint32  `json:"umask,omitempty" platform:"linux,solaris"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty" platform:"linux,solaris"`
+	Username       string   `json:"username,omitempty" platform:"windows"`
 }
 
 // Process from OCI runtime spec
 // github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L30-L57
 type Process struct {
+	User         *User            `json:"user,omitempty"`
 	Env          []string         `json:"env,omitempty"`
 	Capabilities *json.RawMessage `json:"capabilities,omitempty" platform:"linux"`
 }
@@ -79,34 +111,138 @@ type LinuxCapabilities struct {
 }
 
 // Mount from OCI runtime spec
-// https://github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L103
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L121-L133
 type Mount struct {
-	Destination string   `json:"destination"`
-	Type        string   `json:"type,omitempty" platform:"linux,solaris"`
-	Source      string   `json:"source,omitempty"`
-	Options     []string `json:"options,omitempty"`
+	Destination string           `json:"destination"`
+	Type        string           `json:"type,omitempty" platform:"linux,solaris"`
+	Source      string           `json:"source,omitempty"`
+	Options     []string         `json:"options,omitempty"`
+	UIDMappings []LinuxIDMapping `json:"uidMappings,omitempty" platform:"linux"`
+	GIDMappings []LinuxIDMapping `json:"gidMappings,omitempty" platform:"linux"`
+}
+
+// LinuxNamespaceType from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L222-L243
+type LinuxNamespaceType string
+
+// Namespace types supported by the OCI runtime spec. The time namespace was
+// added in v1.1.0.
+const (
+	PIDNamespace     LinuxNamespaceType = "pid"
+	NetworkNamespace LinuxNamespaceType = "network"
+	MountNamespace   LinuxNamespaceType = "mount"
+	IPCNamespace     LinuxNamespaceType = "ipc"
+	UTSNamespace     LinuxNamespaceType = "uts"
+	UserNamespace    LinuxNamespaceType = "user"
+	CgroupNamespace  LinuxNamespaceType = "cgroup"
+	TimeNamespace    LinuxNamespaceType = "time"
+)
+
+// LinuxNamespace from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L214-L220
+type LinuxNamespace struct {
+	Type LinuxNamespaceType `json:"type"`
+	Path string             `json:"path,omitempty"`
+}
+
+// LinuxIDMapping from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L245-L253
+type LinuxIDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+// LinuxDevice from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L479-L495
+type LinuxDevice struct {
+	Path     string       `json:"path"`
+	Type     string       `json:"type"`
+	Major    int64        `json:"major"`
+	Minor    int64        `json:"minor"`
+	FileMode *os.FileMode `json:"fileMode,omitempty"`
+	UID      *uint32      `json:"uid,omitempty"`
+	GID      *uint32      `json:"gid,omitempty"`
+}
+
+// LinuxDeviceCgroup from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L292-L304
+type LinuxDeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Type   string `json:"type,omitempty"`
+	Major  *int64 `json:"major,omitempty"`
+	Minor  *int64 `json:"minor,omitempty"`
+	Access string `json:"access,omitempty"`
+}
+
+// LinuxResources from OCI runtime spec
+// Only the device cgroup rules are modeled here:
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L432-L454
+type LinuxResources struct {
+	Devices []LinuxDeviceCgroup `json:"devices,omitempty"`
+}
+
+// Linux from OCI runtime spec
+// Only the fields the hook needs to reason about are modeled here:
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L170-L212
+type Linux struct {
+	UIDMappings []LinuxIDMapping `json:"uidMappings,omitempty"`
+	GIDMappings []LinuxIDMapping `json:"gidMappings,omitempty"`
+	CgroupsPath string           `json:"cgroupsPath,omitempty"`
+	Namespaces  []LinuxNamespace `json:"namespaces,omitempty"`
+	Resources   *LinuxResources  `json:"resources,omitempty"`
+	Devices     []LinuxDevice    `json:"devices,omitempty"`
+	MountLabel  string           `json:"mountLabel,omitempty"`
+}
+
+// Hook from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L135-L141
+type Hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"`
+}
+
+// Hooks from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/config.go#L143-L166
+type Hooks struct {
+	Prestart        []Hook `json:"prestart,omitempty"`
+	CreateRuntime   []Hook `json:"createRuntime,omitempty"`
+	CreateContainer []Hook `json:"createContainer,omitempty"`
+	StartContainer  []Hook `json:"startContainer,omitempty"`
+	Poststart       []Hook `json:"poststart,omitempty"`
+	Poststop        []Hook `json:"poststop,omitempty"`
 }
 
 // Spec from OCI runtime spec
 // We use pointers to structs, similarly to the latest version of runtime-spec:
 // https://github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L5-L28
 type Spec struct {
-	Version *string  `json:"ociVersion"`
-	Process *Process `json:"process,omitempty"`
-	Root    *Root    `json:"root,omitempty"`
-	Mounts  []Mount  `json:"mounts,omitempty"`
+	Version     *string           `json:"ociVersion"`
+	Process     *Process          `json:"process,omitempty"`
+	Root        *Root             `json:"root,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Hooks       *Hooks            `json:"hooks,omitempty" platform:"linux,solaris"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *Linux            `json:"linux,omitempty" platform:"linux"`
 }
 
 // HookState holds state information about the hook
+// github.com/opencontainers/runtime-spec/blob/v1.2.0/specs-go/state.go#L35-L48
 type HookState struct {
-	Pid int `json:"pid,omitempty"`
+	Version string `json:"ociVersion"`
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Pid     int    `json:"pid,omitempty"`
 	// After 17.06, runc is using the runtime spec:
 	// github.com/docker/runc/blob/17.06/libcontainer/configs/config.go#L262-L263
 	// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/state.go#L3-L17
 	Bundle string `json:"bundle"`
 	// Before 17.06, runc used a custom struct that didn't conform to the spec:
 	// github.com/docker/runc/blob/17.03.x/libcontainer/configs/config.go#L245-L252
-	BundlePath string `json:"bundlePath"`
+	BundlePath  string            `json:"bundlePath"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 func parseCudaVersion(cudaVersion string) (vmaj, vmin, vpatch uint32) {
@@ -142,12 +278,17 @@ func loadSpec(path string) (spec *Spec) {
 	}
 	defer f.Close()
 
-	if err = json.NewDecoder(f).Decode(&spec); err != nil {
+	return decodeSpec(f)
+}
+
+func decodeSpec(r io.Reader) (spec *Spec) {
+	if err := json.NewDecoder(r).Decode(&spec); err != nil {
 		log.Panicln("could not decode OCI spec:", err)
 	}
-	if spec.Version == nil {
+	if spec == nil || spec.Version == nil {
 		log.Panicln("Version is empty in OCI spec")
 	}
+	checkSpecVersion(*spec.Version)
 	if spec.Process == nil {
 		log.Panicln("Process is empty in OCI spec")
 	}
@@ -157,45 +298,81 @@ func loadSpec(path string) (spec *Spec) {
 	return
 }
 
-func isPrivileged(s *Spec) bool {
-	if s.Process.Capabilities == nil {
-		return false
+// checkSpecVersion makes sure we know how to decode the given OCI version.
+// Versions newer than the latest one we know about are decoded as if they were
+// that version, since runtime-spec only adds fields in minor releases.
+func checkSpecVersion(version string) {
+	v := "v" + version
+	if !semver.IsValid(v) {
+		log.Panicln("invalid version in OCI spec:", version)
 	}
+	if semver.Compare(v, minSpecVersion) < 0 {
+		log.Panicln("unsupported version in OCI spec:", version)
+	}
+	if semver.Compare(semver.MajorMinor(v), maxSpecVersion) > 0 {
+		log.Printf("OCI spec version %s is newer than %s, decoding it as %s\n", version, maxSpecVersion[1:], maxSpecVersion[1:])
+	}
+}
 
-	var caps []string
-	// If v1.1.0-rc1 <= OCI version < v1.0.0-rc5 parse s.Process.Capabilities as:
+// getCapabilities returns the capabilities of the container process. Between
+// v1.0.0-rc1 and v1.0.0-rc5 the capabilities were a flat list applied to every
+// set, so we expand them into a LinuxCapabilities struct.
+func (s *Spec) getCapabilities() *LinuxCapabilities {
+	if s.Process == nil || s.Process.Capabilities == nil {
+		return nil
+	}
+
+	// If v1.0.0-rc1 <= OCI version < v1.0.0-rc5 parse s.Process.Capabilities as:
 	// github.com/opencontainers/runtime-spec/blob/v1.0.0-rc1/specs-go/config.go#L30-L54
 	rc1cmp := semver.Compare("v"+*s.Version, "v1.0.0-rc1")
 	rc5cmp := semver.Compare("v"+*s.Version, "v1.0.0-rc5")
 	if (rc1cmp == 1 || rc1cmp == 0) && (rc5cmp == -1) {
+		var caps []string
 		err := json.Unmarshal(*s.Process.Capabilities, &caps)
 		if err != nil {
 			log.Panicln("could not decode Process.Capabilities in OCI spec:", err)
 		}
-		// Otherwise, parse s.Process.Capabilities as:
-		// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L30-L54
-	} else {
-		var lc LinuxCapabilities
-		err := json.Unmarshal(*s.Process.Capabilities, &lc)
-		if err != nil {
-			log.Panicln("could not decode Process.Capabilities in OCI spec:", err)
+		return &LinuxCapabilities{
+			Bounding:    caps,
+			Effective:   caps,
+			Inheritable: caps,
+			Permitted:   caps,
 		}
-		// We only make sure that the bounding capabibility set has
-		// CAP_SYS_ADMIN. This allows us to make sure that the container was
-		// actually started as '--privileged', but also allow non-root users to
-		// access the privileged NVIDIA capabilities.
-		caps = lc.Bounding
 	}
 
-	for _, c := range caps {
-		if c == capSysAdmin {
+	// Otherwise, parse s.Process.Capabilities as:
+	// github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L30-L54
+	var lc LinuxCapabilities
+	err := json.Unmarshal(*s.Process.Capabilities, &lc)
+	if err != nil {
+		log.Panicln("could not decode Process.Capabilities in OCI spec:", err)
+	}
+	return &lc
+}
+
+// hasNamespace returns true if the container is started in a new namespace of
+// the given type.
+func (s *Spec) hasNamespace(t LinuxNamespaceType) bool {
+	if s.Linux == nil {
+		return false
+	}
+	for _, ns := range s.Linux.Namespaces {
+		if ns.Type == t {
 			return true
 		}
 	}
-
 	return false
 }
 
+// hasUserNamespace returns true if the container runs in a user namespace,
+// either because one is requested or because ID mappings are set up.
+func (s *Spec) hasUserNamespace() bool {
+	if s.hasNamespace(UserNamespace) {
+		return true
+	}
+	return s.Linux != nil && (len(s.Linux.UIDMappings) > 0 || len(s.Linux.GIDMappings) > 0)
+}
+
 func isLegacyCUDAImage(env map[string]string) bool {
 	legacyCudaVersion := env[envCUDAVersion]
 	cudaRequire := env[envNVRequireCUDA]
@@ -203,7 +380,7 @@ func isLegacyCUDAImage(env map[string]string) bool {
 }
 
 //从环境变量获取GPU 信息，先查询envSwarmGPU，再查询envVars，如果都未设置，则获取镜像中的设置
-func getDevicesFromEnvvar(env map[string]string, legacyImage bool) *string {
+func getDevicesFromEnvvar(env map[string]string, legacyDevices *string) *string {
 	// Build a list of envvars to consider.
 	// NVIDIA_VISIBLE_DEVICE 中获取
 	envVars := []string{envNVVisibleDevices}
@@ -221,10 +398,9 @@ func getDevicesFromEnvvar(env map[string]string, legacyImage bool) *string {
 		}
 	}
 
-	// Environment variable unset with legacy image: default to "all".
-	if devices == nil && legacyImage {
-		all := "all"
-		return &all
+	// Environment variable unset with legacy image: use the legacy default.
+	if devices == nil && legacyDevices != nil {
+		return legacyDevices
 	}
 
 	// Environment variable unset or empty or "void": return nil
@@ -289,7 +465,11 @@ func getDevices(hookConfig *HookConfig, env map[string]string, mounts []Mount, p
 	}
 
 	// Fallback to reading from the environment variable if privileges are correct
-	devices := getDevicesFromEnvvar(env, legacyImage)
+	var legacyDevices *string
+	if legacyImage {
+		legacyDevices = hookConfig.LegacyImage.getDevices(hookConfig.Pools)
+	}
+	devices := getDevicesFromEnvvar(env, legacyDevices)
 	if devices == nil {
 		return nil
 	}
@@ -298,11 +478,38 @@ func getDevices(hookConfig *HookConfig, env map[string]string, mounts []Mount, p
 	}
 
 	// Error out otherwise
-	log.Panicln("insufficient privileges to read device list from NVIDIA_VISIBLE_DEVICES envvar")
+	deny(deniedReasonPrivileges, "insufficient privileges to read device list from NVIDIA_VISIBLE_DEVICES envvar")
 
 	return nil
 }
 
+// Where the device list of a container comes from.
+const (
+	deviceSourceMounts      = "mounts"
+	deviceSourceEnv         = "env"
+	deviceSourceSwarm       = "swarm"
+	deviceSourceLegacyImage = "legacy-image"
+	deviceSourceDefault     = "default-devices"
+	deviceSourceAnnotation  = "annotation"
+)
+
+// getDeviceSource returns where getDevices found the device list of a GPU
+// container, following the same precedence.
+func getDeviceSource(hookConfig *HookConfig, env map[string]string, mounts []Mount) string {
+	if hookConfig.AcceptDeviceListAsVolumeMounts && getDevicesFromMounts(mounts) != nil {
+		return deviceSourceMounts
+	}
+	if _, ok := env[envNVVisibleDevices]; ok {
+		return deviceSourceEnv
+	}
+	if envSwarmGPU != nil {
+		if _, ok := env[*envSwarmGPU]; ok {
+			return deviceSourceSwarm
+		}
+	}
+	return deviceSourceLegacyImage
+}
+
 func getMigConfigDevices(env map[string]string) *string {
 	if devices, ok := env[envNVMigConfigDevices]; ok {
 		return &devices
@@ -317,7 +524,7 @@ func getMigMonitorDevices(env map[string]string) *string {
 	return nil
 }
 
-func getDriverCapabilities(env map[string]string, legacyImage bool) *string {
+func getDriverCapabilities(env map[string]string, legacyCapabilities *string, allCapabilities string) *string {
 	// Grab a reference to the capabilities from the envvar
 	// if it actually exists in the environment.
 	var capabilities *string
@@ -325,10 +532,9 @@ func getDriverCapabilities(env map[string]string, legacyImage bool) *string {
 		capabilities = &caps
 	}
 
-	// Environment variable unset with legacy image: set all capabilities.
-	if capabilities == nil && legacyImage {
-		allCaps := allDriverCapabilities
-		return &allCaps
+	// Environment variable unset with legacy image: use the legacy default.
+	if capabilities == nil && legacyCapabilities != nil {
+		return legacyCapabilities
 	}
 
 	// Environment variable unset or set but empty: set default capabilities.
@@ -339,8 +545,7 @@ func getDriverCapabilities(env map[string]string, legacyImage bool) *string {
 
 	// Environment variable set to "all": set all capabilities.
 	if *capabilities == "all" {
-		allCaps := allDriverCapabilities
-		return &allCaps
+		return &allCapabilities
 	}
 
 	// Any other value
@@ -348,13 +553,20 @@ func getDriverCapabilities(env map[string]string, legacyImage bool) *string {
 }
 
 func getRequirements(env map[string]string, legacyImage bool) []string {
-	// All variables with the "NVIDIA_REQUIRE_" prefix are passed to nvidia-container-cli
-	var requirements []string
-	for name, value := range env {
+	// All variables with the "NVIDIA_REQUIRE_" prefix are passed to nvidia-container-cli,
+	// in the order of their names.
+	var names []string
+	for name := range env {
 		if strings.HasPrefix(name, envNVRequirePrefix) {
-			requirements = append(requirements, value)
+			names = append(names, name)
 		}
 	}
+	sort.Strings(names)
+
+	var requirements []string
+	for _, name := range names {
+		requirements = append(requirements, env[name])
+	}
 	if legacyImage {
 		vmaj, vmin, _ := parseCudaVersion(env[envCUDAVersion])
 		cudaRequire := fmt.Sprintf("cuda>=%d.%d", vmaj, vmin)
@@ -373,13 +585,18 @@ func getNvidiaConfig(hookConfig *HookConfig, env map[string]string, mounts []Mou
 		// 'nil' devices means this is not a GPU container.
 		return nil
 	}
+	return getNvidiaConfigForDevices(hookConfig, env, devices, privileged, legacyImage)
+}
 
+// getNvidiaConfigForDevices returns the config of a GPU container getting the
+// given devices.
+func getNvidiaConfigForDevices(hookConfig *HookConfig, env map[string]string, devices string, privileged bool, legacyImage bool) *nvidiaConfig {
 	var migConfigDevices string
 	if d := getMigConfigDevices(env); d != nil {
 		migConfigDevices = *d
 	}
 	if !privileged && migConfigDevices != "" {
-		log.Panicln("cannot set MIG_CONFIG_DEVICES in non privileged container")
+		deny(deniedReasonPrivileges, "cannot set MIG_CONFIG_DEVICES in non privileged container")
 	}
 
 	var migMonitorDevices string
@@ -387,18 +604,27 @@ func getNvidiaConfig(hookConfig *HookConfig, env map[string]string, mounts []Mou
 		migMonitorDevices = *d
 	}
 	if !privileged && migMonitorDevices != "" {
-		log.Panicln("cannot set MIG_MONITOR_DEVICES in non privileged container")
+		deny(deniedReasonPrivileges, "cannot set MIG_MONITOR_DEVICES in non privileged container")
 	}
 
 	var driverCapabilities string
-	if c := getDriverCapabilities(env, legacyImage); c != nil {
+	allCapabilities := getCapabilityRegistry(&hookConfig.DriverCapabilities).all(getDriverRoot(hookConfig))
+	var legacyCapabilities *string
+	if legacyImage {
+		legacyCapabilities = hookConfig.LegacyImage.getCapabilities(allCapabilities)
+	}
+	if c := getDriverCapabilities(env, legacyCapabilities, allCapabilities); c != nil {
 		driverCapabilities = *c
 	}
 
-	requirements := getRequirements(env, legacyImage)
+	requirements := getRequirements(env, legacyImage && hookConfig.LegacyImage.AddCUDARequirement)
+	requirements = append(requirements, hookConfig.Requirements.Node...)
 
 	// Don't fail on invalid values.
 	disableRequire, _ := strconv.ParseBool(env[envNVDisableRequire])
+	if hookConfig.Requirements.Enforce {
+		disableRequire = false
+	}
 
 	return &nvidiaConfig{
 		Devices:            devices,
@@ -410,27 +636,74 @@ func getNvidiaConfig(hookConfig *HookConfig, env map[string]string, mounts []Mou
 	}
 }
 
-func getContainerConfig(hook HookConfig) (config containerConfig) {
-	var h HookState
-	d := json.NewDecoder(os.Stdin)
-	if err := d.Decode(&h); err != nil {
+func getHookState(r io.Reader) (state HookState) {
+	d := json.NewDecoder(r)
+	if err := d.Decode(&state); err != nil {
 		log.Panicln("could not decode container state:", err)
 	}
+	return
+}
 
-	b := h.Bundle
-	if len(b) == 0 {
-		b = h.BundlePath
+// getBundle returns the bundle directory from either the runtime spec field or
+// the legacy runc one.
+func (h HookState) getBundle() string {
+	if len(h.Bundle) > 0 {
+		return h.Bundle
 	}
+	return h.BundlePath
+}
+
+func getContainerConfig(hook HookConfig, h HookState) (config containerConfig) {
+	b := h.getBundle()
 
 	s := loadSpec(path.Join(b, "config.json"))
 
 	env := getEnvMap(s.Process.Env)
-	privileged := isPrivileged(s)
+	decision := getPrivilegeDecision(&hook.Privilege, s)
+	logDebug(fmt.Sprintf("privileged: %v (%s)", decision.Privileged, strings.Join(decision.Reasons, ", ")))
+	privileged := decision.Privileged
 	envSwarmGPU = hook.SwarmResource
-	return containerConfig{
-		Pid:    h.Pid,
-		Rootfs: s.Root.Path,
-		Env:    env,
-		Nvidia: getNvidiaConfig(&hook, env, s.Mounts, privileged),
-	}
+	profile := getProfile(&hook, s.Annotations)
+	nvidia := getNvidiaConfig(&hook, env, s.Mounts, privileged)
+	defaultDevices := nvidia == nil && usesDefaultDevices(&hook, profile, env, s.Mounts)
+	if nvidia != nil || defaultDevices {
+		checkProfile(&hook, profile)
+	}
+	var source string
+	if nvidia != nil {
+		source = getDeviceSource(&hook, env, s.Mounts)
+	} else if defaultDevices {
+		devices, err := getDefaultDevices(&hook, getDefaultDevicesPolicy(&hook, profile), h.ID, *dryrunflag)
+		if err != nil {
+			log.Panicln("could not get the default devices:", err)
+		}
+		nvidia = getNvidiaConfigForDevices(&hook, env, devices, privileged, false)
+		source = deviceSourceDefault
+	}
+	cdiDevices := getCDIDevicesFromAnnotations(s.Annotations)
+	if nvidia == nil && len(cdiDevices) > 0 {
+		source = deviceSourceAnnotation
+	}
+	config = containerConfig{
+		ID:            h.ID,
+		Pid:           h.Pid,
+		Bundle:        b,
+		Rootfs:        s.Root.Path,
+		Env:           env,
+		UserNamespace: s.hasUserNamespace(),
+		Privileged:    privileged,
+		Profile:       profile,
+		DeviceSource:  source,
+		CDIDevices:    cdiDevices,
+		Nvidia:        nvidia,
+	}
+	if s.Linux != nil {
+		config.UIDMappings = s.Linux.UIDMappings
+		config.GIDMappings = s.Linux.GIDMappings
+	}
+	if config.Nvidia != nil {
+		config.Nvidia.Capabilities = applyCapabilityPolicy(&hook, config.Nvidia, privileged, config.Profile)
+		config.Nvidia.DriverCapabilities = getCapabilityNames(config.Nvidia.Capabilities)
+	}
+	return config
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The devices of GPU containers not setting a device list, when the
+// default-devices policy is not "none". "pool:<name>" gives the devices of a
+// pool.
+const (
+	defaultDevicesNone      = "none"
+	defaultDevicesAll       = "all"
+	defaultDevicesFirstFree = "first-free"
+
+	// A lease is acquired before the record of its container is saved, it
+	// only counts without a record for that long.
+	leaseGracePeriod = time.Minute
+)
+
+// getDefaultDevicesPolicy returns the default-devices policy of the profile,
+// or the global one.
+func getDefaultDevicesPolicy(hook *HookConfig, profile string) string {
+	if p, ok := hook.Profiles[profile]; ok && len(p.DefaultDevices) > 0 {
+		return p.DefaultDevices
+	}
+	return hook.DefaultDevices
+}
+
+// checkDefaultDevices validates the default-devices policies, so that a typo
+// fails when the configuration loads rather than for every container without
+// a device list. Leasing the first free device needs the container ID and the
+// poststop hook, which modify-spec mode has neither of.
+func checkDefaultDevices(hook *HookConfig) error {
+	keys := []string{"default-devices"}
+	policies := []string{hook.DefaultDevices}
+	var profiles []string
+	for name := range hook.Profiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	for _, name := range profiles {
+		if p := hook.Profiles[name].DefaultDevices; len(p) > 0 {
+			keys = append(keys, fmt.Sprintf("profiles.%s.default-devices", name))
+			policies = append(policies, p)
+		}
+	}
+
+	for i, policy := range policies {
+		switch {
+		case policy == defaultDevicesNone, policy == defaultDevicesAll:
+		case policy == defaultDevicesFirstFree:
+			if hook.NvidiaContainerRuntime.Mode == runtimeModeModifySpec {
+				return fmt.Errorf("%s: %q is not supported in %s mode", keys[i], policy, runtimeModeModifySpec)
+			}
+		case strings.HasPrefix(policy, poolDevicesPrefix):
+			if _, ok := hook.Pools[strings.TrimPrefix(policy, poolDevicesPrefix)]; !ok {
+				return fmt.Errorf("%s: unknown pool in %q", keys[i], policy)
+			}
+		default:
+			return fmt.Errorf("%s: invalid default devices %q", keys[i], policy)
+		}
+	}
+	return nil
+}
+
+// hasDeviceList returns true if the container says which devices it wants,
+// including none or "void". Legacy images have their own default.
+func hasDeviceList(hook *HookConfig, env map[string]string, mounts []Mount) bool {
+	if _, ok := env[envNVVisibleDevices]; ok {
+		return true
+	}
+	if envSwarmGPU != nil {
+		if _, ok := env[*envSwarmGPU]; ok {
+			return true
+		}
+	}
+	if hook.AcceptDeviceListAsVolumeMounts && getDevicesFromMounts(mounts) != nil {
+		return true
+	}
+	return isLegacyCUDAImage(env)
+}
+
+// usesDefaultDevices returns true if the container gets the default devices.
+func usesDefaultDevices(hook *HookConfig, profile string, env map[string]string, mounts []Mount) bool {
+	return getDefaultDevicesPolicy(hook, profile) != defaultDevicesNone && !hasDeviceList(hook, env, mounts)
+}
+
+// getDefaultDevices returns the device list of the policy. The first free
+// device is leased to the container with the given ID, unless in a dry run.
+func getDefaultDevices(hook *HookConfig, policy string, id string, dryRun bool) (string, error) {
+	switch {
+	case policy == defaultDevicesAll:
+		return "all", nil
+	case policy == defaultDevicesFirstFree:
+		return acquireFirstFreeDevice(hook, id, dryRun)
+	case strings.HasPrefix(policy, poolDevicesPrefix):
+		return getPoolDevices(hook.Pools, strings.TrimPrefix(policy, poolDevicesPrefix)), nil
+	}
+	return "", fmt.Errorf("invalid default devices %q", policy)
+}
+
+// isLeased returns true if the GPU of the given index, or a MIG device of it,
+// is held by a container. Leases are taken on the devices as containers name
+// them, so they are mapped to their index through the inventory, and a lease
+// on all the devices holds every GPU.
+func isLeased(stateDir string, inv *Inventory, index string) (bool, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(stateDir, "leases"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, dir := range dirs {
+		name, err := url.PathUnescape(dir.Name())
+		if err != nil {
+			continue
+		}
+		if canonical, _ := getCanonicalDevice(inv, name); name != "all" && canonical != index && !strings.HasPrefix(canonical, index+":") {
+			continue
+		}
+
+		leases, err := ioutil.ReadDir(getLeaseDir(stateDir, name))
+		if err != nil {
+			return false, err
+		}
+		for _, lease := range leases {
+			if time.Since(lease.ModTime()) < leaseGracePeriod {
+				return true, nil
+			}
+			// Leases outliving their record are stale.
+			if record, _ := loadContainerRecord(stateDir, lease.Name()); record != nil {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// acquireFirstFreeDevice leases the first GPU of the inventory that no
+// container holds. A dry run only tells which GPU it would be, leaving the
+// state directory untouched.
+func acquireFirstFreeDevice(hook *HookConfig, id string, dryRun bool) (string, error) {
+	if err := canRecord(hook.StateDir, id); err != nil {
+		return "", fmt.Errorf("cannot lease a device: %v", err)
+	}
+	inv, err := loadInventory(hook.Inventory)
+	if err != nil {
+		return "", err
+	}
+
+	// Picking a device and leasing it must not race with other containers.
+	if !dryRun {
+		lock, err := lockLeases(hook.StateDir)
+		if err != nil {
+			return "", err
+		}
+		defer lock.Close()
+	}
+
+	for _, gpu := range inv.GPUs {
+		index := strconv.Itoa(gpu.Index)
+		leased, err := isLeased(hook.StateDir, inv, index)
+		if err != nil {
+			return "", err
+		}
+		if leased {
+			continue
+		}
+		if dryRun {
+			return index, nil
+		}
+		if _, err := acquireLeases(hook.StateDir, id, []string{index}); err != nil {
+			return "", err
+		}
+		return index, nil
+	}
+	return "", fmt.Errorf("no free device")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsesDefaultDevices(t *testing.T) {
+	hook := getDefaultHookConfig()
+	hook.DefaultDevices = defaultDevicesAll
+	hook.Profiles = map[string]ProfileConfig{
+		"batch":   {DefaultDevices: defaultDevicesNone},
+		"default": {},
+	}
+
+	tests := []struct {
+		description string
+		profile     string
+		env         map[string]string
+		expected    bool
+	}{
+		{
+			description: "no device list",
+			expected:    true,
+		},
+		{
+			description: "profile without override",
+			profile:     "default",
+			expected:    true,
+		},
+		{
+			description: "profile override",
+			profile:     "batch",
+			expected:    false,
+		},
+		{
+			description: "void device list",
+			env:         map[string]string{envNVVisibleDevices: "void"},
+			expected:    false,
+		},
+		{
+			description: "legacy image",
+			env:         map[string]string{envCUDAVersion: "10.2"},
+			expected:    false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			if r := usesDefaultDevices(&hook, tc.profile, tc.env, nil); r != tc.expected {
+				t.Errorf("Expected %v", tc.expected)
+			}
+		})
+	}
+}
+
+func TestAcquireFirstFreeDevice(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "default-devices-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hook := getDefaultHookConfig()
+	hook.StateDir = filepath.Join(tmp, "state")
+	hook.Inventory = filepath.Join(tmp, "inventory.toml")
+	if err := ioutil.WriteFile(hook.Inventory, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run leases nothing.
+	if d, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "a", true); err != nil || d != "0" {
+		t.Fatalf("Unexpected device %q: %v", d, err)
+	}
+	if _, err := os.Stat(hook.StateDir); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected state directory: %v", err)
+	}
+
+	if d, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "a", false); err != nil || d != "0" {
+		t.Fatalf("Unexpected device %q: %v", d, err)
+	}
+	// MIG devices hold their GPU.
+	if _, err := acquireLeases(hook.StateDir, "b", []string{"1:0"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "c", false); err == nil {
+		t.Fatal("Expected no free device")
+	}
+
+	// Leases without a record are stale after the grace period, those with
+	// a record are held until the container is released.
+	if err := saveContainerRecord(hook.StateDir, &containerRecord{ID: "a", Devices: "0", Leases: []string{filepath.Join(getLeaseDir(hook.StateDir, "0"), "a")}}); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * leaseGracePeriod)
+	for _, lease := range []string{filepath.Join(getLeaseDir(hook.StateDir, "0"), "a"), filepath.Join(getLeaseDir(hook.StateDir, "1:0"), "b")} {
+		if err := os.Chtimes(lease, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "c", false); err != nil || d != "1" {
+		t.Fatalf("Unexpected device %q: %v", d, err)
+	}
+	if err := releaseContainer(&hook, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "d", false); err != nil || d != "0" {
+		t.Fatalf("Unexpected device %q: %v", d, err)
+	}
+
+	// A container getting all the devices, by UUID or MIG UUID, holds them.
+	hook.StateDir = filepath.Join(tmp, "holders")
+	for _, holder := range []string{"all", "GPU-0", "MIG-GPU-1/0/0"} {
+		if _, err := acquireLeases(hook.StateDir, "e", []string{holder}); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveContainerRecord(hook.StateDir, &containerRecord{ID: "e", Devices: holder}); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"all": "", "GPU-0": "1", "MIG-GPU-1/0/0": "0"}[holder]
+		d, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "f", true)
+		if d != expected || (len(expected) == 0) != (err != nil) {
+			t.Errorf("Unexpected device %q with %s held: %v", d, holder, err)
+		}
+		if err := os.RemoveAll(getLeaseDir(hook.StateDir, holder)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a container ID, nothing can be leased.
+	if _, err := getDefaultDevices(&hook, defaultDevicesFirstFree, "", false); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestCheckDefaultDevices(t *testing.T) {
+	tests := []struct {
+		description string
+		policy      string
+		profile     string
+		mode        string
+		expectError bool
+	}{
+		{
+			description: "none",
+			policy:      defaultDevicesNone,
+		},
+		{
+			description: "pool",
+			policy:      "pool:inference",
+		},
+		{
+			description: "first free",
+			policy:      defaultDevicesFirstFree,
+		},
+		{
+			description: "typo",
+			policy:      "first_free",
+			expectError: true,
+		},
+		{
+			description: "unknown pool",
+			policy:      "pool:training",
+			expectError: true,
+		},
+		{
+			description: "typo in profile",
+			policy:      defaultDevicesNone,
+			profile:     "al",
+			expectError: true,
+		},
+		{
+			description: "first free in modify-spec mode",
+			policy:      defaultDevicesNone,
+			profile:     defaultDevicesFirstFree,
+			mode:        runtimeModeModifySpec,
+			expectError: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			hook := getDefaultHookConfig()
+			hook.DefaultDevices = tc.policy
+			hook.Pools = map[string]PoolConfig{"inference": {Devices: []string{"0"}}}
+			hook.Profiles = map[string]ProfileConfig{"batch": {DefaultDevices: tc.profile}}
+			if len(tc.mode) > 0 {
+				hook.NvidiaContainerRuntime.Mode = tc.mode
+			}
+			if err := checkDefaultDevices(&hook); (err != nil) != tc.expectError {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func orUnknown(s string) string {
+	if len(s) == 0 {
+		return "unknown"
+	}
+	return s
+}
+
+func printFacts(w io.Writer, facts *hostFacts) {
+	fmt.Fprintf(w, "driver version: %s\n", orUnknown(facts.DriverVersion))
+	if len(facts.LibCUDAPath) > 0 {
+		fmt.Fprintf(w, "libcuda: %s (%s)\n", facts.LibCUDAPath, facts.LibCUDAVersion)
+	} else {
+		fmt.Fprintf(w, "libcuda: not found\n")
+	}
+	fmt.Fprintf(w, "CUDA version: %s\n", orUnknown(facts.CUDAVersion))
+	for _, gpu := range facts.GPUs {
+		fmt.Fprintf(w, "GPU %d: uuid %s, arch %s, brand %s\n", gpu.Index, orUnknown(gpu.UUID), orUnknown(gpu.Arch), orUnknown(gpu.Brand))
+	}
+}
+
+// printDryRun prints what the prestart hook would do for the container.
+func printDryRun(w io.Writer, facts *hostFacts, container *containerConfig, args []string, compat *cudaCompat, requireErr error) {
+	printFacts(w, facts)
+	fmt.Fprintf(w, "container: %s\n", container.ID)
+	fmt.Fprintf(w, "privileged: %v\n", container.Privileged)
+	if len(container.Profile) > 0 {
+		fmt.Fprintf(w, "profile: %s\n", container.Profile)
+	}
+	fmt.Fprintf(w, "devices: %s\n", container.Nvidia.Devices)
+	fmt.Fprintf(w, "capabilities: %s\n", container.Nvidia.DriverCapabilities)
+	if compat != nil {
+		fmt.Fprintf(w, "CUDA compat: %s (CUDA %s)\n", compat.LibCUDAPath, compat.CUDAVersion)
+	}
+	fmt.Fprintf(w, "requirements: %s\n", strings.Join(container.Nvidia.Requirements, " ; "))
+	if requireErr != nil {
+		fmt.Fprintf(w, "requirements check: %v\n", requireErr)
+	} else {
+		fmt.Fprintf(w, "requirements check: ok\n")
+	}
+	fmt.Fprintf(w, "command: %s\n", strings.Join(args, " "))
+}
+
+type doctorCheck struct {
+	name string
+	err  error
+}
+
+func getDoctorChecks(hook *HookConfig, facts *hostFacts) []doctorCheck {
+	var checks []doctorCheck
+	check := func(name string, err error) {
+		checks = append(checks, doctorCheck{name, err})
+	}
+
+	cli := "nvidia-container-cli"
+	if hook.NvidiaContainerCLI.Path != nil {
+		cli = *hook.NvidiaContainerCLI.Path
+	}
+	_, err := exec.LookPath(cli)
+	check("nvidia-container-cli found", err)
+
+	if len(facts.DriverVersion) == 0 {
+		err = fmt.Errorf("no driver version in %s/driver/nvidia/version, is the nvidia kernel module loaded?", hook.Facts.ProcRoot)
+	} else {
+		err = nil
+	}
+	check("driver loaded", err)
+
+	if len(facts.LibCUDAPath) == 0 {
+		err = fmt.Errorf("libcuda.so not found under the driver root")
+	} else if facts.LibCUDAVersion != facts.DriverVersion && len(facts.DriverVersion) > 0 {
+		err = fmt.Errorf("libcuda.so.%s does not match the driver version %s", facts.LibCUDAVersion, facts.DriverVersion)
+	} else {
+		err = nil
+	}
+	check("driver libraries installed", err)
+
+	if _, err := os.Stat(hook.Inventory); err == nil {
+		_, err = loadInventory(hook.Inventory)
+		check("inventory valid", err)
+	}
+
+	_, err = loadCDISpecs(hook.CDISpecDirs)
+	check("CDI specs valid", err)
+
+	if len(hook.StateDir) > 0 {
+		err = os.MkdirAll(hook.StateDir, 0700)
+		check("state directory usable", err)
+	}
+	return checks
+}
+
+// doDoctor prints the host facts and checks the setup, failing if any of the
+// checks fail.
+func doDoctor() {
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	facts := getHostFacts(&hook)
+	printFacts(os.Stdout, &facts)
+
+	failed := false
+	for _, c := range getDoctorChecks(&hook, &facts) {
+		if c.err != nil {
+			failed = true
+			fmt.Printf("FAIL %s: %v\n", c.name, c.err)
+		} else {
+			fmt.Printf("ok   %s\n", c.name)
+		}
+	}
+	if failed {
+		log.Panicln("some checks failed")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultProcRoot = "/proc"
+	defaultSysRoot  = "/sys"
+)
+
+// FactsConfig : where host facts are read from. The roots can point to
+// fixture trees.
+type FactsConfig struct {
+	ProcRoot string `toml:"proc-root"`
+	SysRoot  string `toml:"sys-root"`
+}
+
+// e.g. "NVRM version: NVIDIA UNIX x86_64 Kernel Module  450.80.02  Wed Sep 23 01:13:39 UTC 2020"
+// or "NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  535.104.05  Release Build ..."
+var driverVersionPattern = regexp.MustCompile(`Kernel Module(?: for \S+)?\s+([0-9][0-9.]*)`)
+
+var libcudaPattern = regexp.MustCompile(`^libcuda\.so\.([0-9]+\.[0-9.]+)$`)
+
+// Where the driver libraries are installed, relative to the driver root.
+var driverLibraryDirs = []string{
+	"usr/lib64",
+	"usr/lib/x86_64-linux-gnu",
+	"usr/lib/aarch64-linux-gnu",
+	"usr/lib/powerpc64le-linux-gnu",
+	"usr/lib",
+	"lib64",
+	"lib/x86_64-linux-gnu",
+}
+
+// The minimum driver version of each CUDA version, newest first:
+// https://docs.nvidia.com/deploy/cuda-compatibility/
+var cudaDriverVersions = []struct {
+	cuda   string
+	driver string
+}{
+	{"12.6", "560.28.03"},
+	{"12.5", "555.42.02"},
+	{"12.4", "550.54.14"},
+	{"12.3", "545.23.06"},
+	{"12.2", "535.54.03"},
+	{"12.1", "530.30.02"},
+	{"12.0", "525.60.13"},
+	{"11.8", "520.61.05"},
+	{"11.7", "515.43.04"},
+	{"11.6", "510.39.01"},
+	{"11.5", "495.29.05"},
+	{"11.4", "470.42.01"},
+	{"11.3", "465.19.01"},
+	{"11.2", "460.27.03"},
+	{"11.1", "455.23"},
+	{"11.0", "450.36.06"},
+	{"10.2", "440.33"},
+	{"10.1", "418.39"},
+	{"10.0", "410.48"},
+	{"9.2", "396.26"},
+	{"9.1", "390.46"},
+	{"9.0", "384.81"},
+	{"8.0", "367.48"},
+}
+
+func parseDriverVersion(data []byte) string {
+	m := driverVersionPattern.FindSubmatch(data)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+// getCUDAVersion returns the newest CUDA version supported by the driver, or
+// "" if it is unknown. Driver branches newer than the table may support newer
+// CUDA versions, which are then unknown too: their requirements are left to
+// nvidia-container-cli, which asks the driver.
+func getCUDAVersion(driverVersion string) string {
+	v, err := parseVersion(driverVersion)
+	if err != nil {
+		return ""
+	}
+	if newest, _ := parseVersion(cudaDriverVersions[0].driver); v[0] > newest[0] {
+		return ""
+	}
+	for _, e := range cudaDriverVersions {
+		min, _ := parseVersion(e.driver)
+		if compareVersions(v, min) >= 0 {
+			return e.cuda
+		}
+	}
+	return ""
+}
+
+// getDriverVersion reads the version of the loaded kernel module.
+func getDriverVersion(config *FactsConfig) string {
+	if data, err := ioutil.ReadFile(filepath.Join(config.ProcRoot, "driver/nvidia/version")); err == nil {
+		if v := parseDriverVersion(data); len(v) > 0 {
+			return v
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(config.SysRoot, "module/nvidia/version")); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// findLibCUDA returns the path and version of the versioned libcuda.so under
+// the driver root.
+func findLibCUDA(root string) (string, string) {
+	for _, dir := range driverLibraryDirs {
+		matches, _ := filepath.Glob(filepath.Join(root, dir, "libcuda.so.*"))
+		for _, m := range matches {
+			if v := libcudaPattern.FindStringSubmatch(filepath.Base(m)); v != nil {
+				return m, v[1]
+			}
+		}
+	}
+	return "", ""
+}
+
+// gpuFacts : what the requirements can constrain about a GPU.
+type gpuFacts struct {
+	Index int
+	UUID  string
+	Arch  string
+	Brand string
+}
+
+// hostFacts : what the requirements can constrain about the host. Empty
+// values are unknown.
+type hostFacts struct {
+	DriverVersion string
+	// The version of the libcuda.so of the driver, which tells the CUDA
+	// version the driver supports.
+	LibCUDAPath    string
+	LibCUDAVersion string
+	CUDAVersion    string
+	GPUs           []gpuFacts
+}
+
+// getDriverRoot returns where the driver files are, "/" unless the driver is
+// containerized.
+func getDriverRoot(hook *HookConfig) string {
+	if hook.NvidiaContainerCLI.Root != nil {
+		return *hook.NvidiaContainerCLI.Root
+	}
+	return "/"
+}
+
+// getHostFacts returns what is known about the host, facts that cannot be
+// read being left empty.
+func getHostFacts(hook *HookConfig) hostFacts {
+	var facts hostFacts
+	facts.DriverVersion = getDriverVersion(&hook.Facts)
+
+	facts.LibCUDAPath, facts.LibCUDAVersion = findLibCUDA(getDriverRoot(hook))
+	if len(facts.LibCUDAVersion) > 0 {
+		facts.CUDAVersion = getCUDAVersion(facts.LibCUDAVersion)
+	} else {
+		facts.CUDAVersion = getCUDAVersion(facts.DriverVersion)
+	}
+
+	// The inventory is optional.
+	if inv, err := loadInventory(hook.Inventory); err == nil {
+		facts.GPUs = getGPUFacts(inv)
+	}
+	return facts
+}
+
+func getGPUFacts(inv *Inventory) []gpuFacts {
+	var gpus []gpuFacts
+	for _, gpu := range inv.GPUs {
+		gpus = append(gpus, gpuFacts{
+			Index: gpu.Index,
+			UUID:  gpu.UUID,
+			Arch:  gpu.Arch,
+			Brand: gpu.Brand,
+		})
+	}
+	return gpus
+}
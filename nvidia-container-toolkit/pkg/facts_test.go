@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFixture(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDriverVersion(t *testing.T) {
+	tests := map[string]string{
+		"NVRM version: NVIDIA UNIX x86_64 Kernel Module  450.80.02  Wed Sep 23 01:13:39 UTC 2020\n":   "450.80.02",
+		"NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  535.104.05  Release Build  (dvs)\n": "535.104.05",
+		"garbage": "",
+	}
+	for data, expected := range tests {
+		if v := parseDriverVersion([]byte(data)); v != expected {
+			t.Errorf("Unexpected driver version %q for %q", v, data)
+		}
+	}
+}
+
+func TestGetCUDAVersion(t *testing.T) {
+	tests := map[string]string{
+		"450.80.02":  "11.0",
+		"450.36.06":  "11.0",
+		"450.36.05":  "10.2",
+		"535.104.05": "12.2",
+		"560.35.03":  "12.6",
+		"570.86.15":  "",
+		"999.0":      "",
+		"300.0":      "",
+		"foo":        "",
+	}
+	for driver, expected := range tests {
+		if v := getCUDAVersion(driver); v != expected {
+			t.Errorf("Unexpected CUDA version %q for driver %s", v, driver)
+		}
+	}
+}
+
+func TestGetHostFacts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "facts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFixture(t, filepath.Join(tmp, "proc/driver/nvidia/version"), "NVRM version: NVIDIA UNIX x86_64 Kernel Module  450.80.02  Wed Sep 23 01:13:39 UTC 2020\n")
+	writeFixture(t, filepath.Join(tmp, "sys/module/nvidia/version"), "418.87.01\n")
+	writeFixture(t, filepath.Join(tmp, "driver/usr/lib64/libcuda.so.1"), "")
+	writeFixture(t, filepath.Join(tmp, "driver/usr/lib64/libcuda.so.450.80.02"), "")
+	writeFixture(t, filepath.Join(tmp, "inventory.toml"), "[[gpus]]\nindex = 0\nuuid = \"GPU-0\"\narch = \"7.0\"\nbrand = \"tesla\"\n")
+
+	hook := getDefaultHookConfig()
+	hook.Facts = FactsConfig{ProcRoot: filepath.Join(tmp, "proc"), SysRoot: filepath.Join(tmp, "sys")}
+	driverRoot := filepath.Join(tmp, "driver")
+	hook.NvidiaContainerCLI.Root = &driverRoot
+	hook.Inventory = filepath.Join(tmp, "inventory.toml")
+
+	facts := getHostFacts(&hook)
+	if facts.DriverVersion != "450.80.02" || facts.LibCUDAVersion != "450.80.02" || facts.CUDAVersion != "11.0" {
+		t.Errorf("Unexpected facts: %+v", facts)
+	}
+	if len(facts.GPUs) != 1 || facts.GPUs[0].Arch != "7.0" || facts.GPUs[0].Brand != "tesla" {
+		t.Errorf("Unexpected GPU facts: %+v", facts.GPUs)
+	}
+	if _, err := checkRequirements([]string{"cuda>=11.0,brand=tesla", "arch>=7.0"}, &facts, "0"); err != nil {
+		t.Error(err)
+	}
+
+	// Without /proc, the version of the loaded module is read from /sys.
+	// Without libcuda, the CUDA version follows the driver version.
+	os.RemoveAll(filepath.Join(tmp, "proc"))
+	os.RemoveAll(driverRoot)
+	facts = getHostFacts(&hook)
+	if facts.DriverVersion != "418.87.01" || facts.LibCUDAPath != "" || facts.CUDAVersion != "10.1" {
+		t.Errorf("Unexpected facts: %+v", facts)
+	}
+
+	var out bytes.Buffer
+	printFacts(&out, &facts)
+	if !strings.Contains(out.String(), "libcuda: not found") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+
+	checks := getDoctorChecks(&hook, &facts)
+	for _, c := range checks {
+		if c.name == "driver libraries installed" && c.err == nil {
+			t.Error("Expected the libcuda check to fail")
+		}
+	}
+}
+
+func TestGetHostFactsNewerDriver(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "facts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFixture(t, filepath.Join(tmp, "proc/driver/nvidia/version"), "NVRM version: NVIDIA UNIX Open Kernel Module for x86_64  570.86.15  Release Build  (dvs)\n")
+	writeFixture(t, filepath.Join(tmp, "driver/usr/lib64/libcuda.so.570.86.15"), "")
+
+	hook := getDefaultHookConfig()
+	hook.Facts = FactsConfig{ProcRoot: filepath.Join(tmp, "proc"), SysRoot: filepath.Join(tmp, "sys")}
+	driverRoot := filepath.Join(tmp, "driver")
+	hook.NvidiaContainerCLI.Root = &driverRoot
+	hook.Inventory = filepath.Join(tmp, "inventory.toml")
+
+	// The CUDA version of a driver newer than the table is unknown, rather
+	// than the newest one of the table.
+	facts := getHostFacts(&hook)
+	if facts.DriverVersion != "570.86.15" || facts.CUDAVersion != "" {
+		t.Errorf("Unexpected facts: %+v", facts)
+	}
+	unknown, err := checkRequirements([]string{"cuda>=12.8"}, &facts, "all")
+	if err != nil || !unknown {
+		t.Errorf("Unexpected requirement check: %v, %v", unknown, err)
+	}
+	if _, err := checkRequirements([]string{"driver>=570"}, &facts, "all"); err != nil {
+		t.Error(err)
+	}
+}
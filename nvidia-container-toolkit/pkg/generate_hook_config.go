@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultHookPath = "/usr/bin/nvidia-container-toolkit"
+
+	// The hooks.d configuration read by podman and CRI-O:
+	// https://github.com/containers/common/blob/main/pkg/hooks/docs/oci-hooks.5.md
+	hookFormatHooksD = "hooks.d"
+	// The hooks object of the OCI runtime spec, for runtimes and tools
+	// that take hooks straight from config.json.
+	hookFormatOCI = "oci"
+
+	hooksDVersion = "1.0.0"
+)
+
+// hooksDWhen holds the conditions under which podman and CRI-O inject a hook.
+// The hook is injected as soon as one of the conditions matches.
+type hooksDWhen struct {
+	Always        *bool             `json:"always,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	Commands      []string          `json:"commands,omitempty"`
+	HasBindMounts *bool             `json:"hasBindMounts,omitempty"`
+}
+
+// hooksDConfig is the 1.0.0 schema of a hooks.d file.
+type hooksDConfig struct {
+	Version string     `json:"version"`
+	Hook    Hook       `json:"hook"`
+	When    hooksDWhen `json:"when"`
+	Stages  []string   `json:"stages"`
+}
+
+type hookConfigOptions struct {
+	Format        string
+	Stage         string
+	OCIVersion    string
+	HookPath      string
+	PathEnv       string
+	Annotations   []string
+	Commands      []string
+	HasBindMounts bool
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func getHookStage(opts *hookConfigOptions) (string, error) {
+	if len(opts.Stage) == 0 {
+		return getInjectionStage(opts.OCIVersion), nil
+	}
+	if (&Hooks{}).getStage(opts.Stage) == nil {
+		return "", fmt.Errorf("unknown hook stage %q", opts.Stage)
+	}
+	if err := checkHookStage(opts.Stage); err != nil {
+		return "", err
+	}
+	newStage := opts.Stage == stageCreateRuntime || opts.Stage == stageCreateContainer
+	if newStage && len(opts.OCIVersion) > 0 && !supportsNewHookStages(opts.OCIVersion) {
+		return "", fmt.Errorf("stage %s is not supported by runtimes implementing OCI %s", opts.Stage, opts.OCIVersion)
+	}
+	return opts.Stage, nil
+}
+
+func getHooksDWhen(opts *hookConfigOptions) (hooksDWhen, error) {
+	var when hooksDWhen
+
+	for _, a := range opts.Annotations {
+		p := strings.SplitN(a, "=", 2)
+		if len(p) != 2 {
+			return when, fmt.Errorf("invalid annotation condition %q, expected KEY_REGEX=VALUE_REGEX", a)
+		}
+		for _, re := range p {
+			if _, err := regexp.Compile(re); err != nil {
+				return when, fmt.Errorf("invalid annotation condition %q: %v", a, err)
+			}
+		}
+		if when.Annotations == nil {
+			when.Annotations = make(map[string]string)
+		}
+		when.Annotations[p[0]] = p[1]
+	}
+
+	for _, c := range opts.Commands {
+		if _, err := regexp.Compile(c); err != nil {
+			return when, fmt.Errorf("invalid command condition %q: %v", c, err)
+		}
+		when.Commands = append(when.Commands, c)
+	}
+
+	if opts.HasBindMounts {
+		hasBindMounts := true
+		when.HasBindMounts = &hasBindMounts
+	}
+
+	// Without any condition, the hook applies to every container.
+	if when.Annotations == nil && when.Commands == nil && when.HasBindMounts == nil {
+		always := true
+		when.Always = &always
+	}
+
+	return when, nil
+}
+
+// generateHookConfig returns the JSON configuration of the hook for the given
+// stage, in either the hooks.d or the OCI runtime spec format.
+func generateHookConfig(opts *hookConfigOptions) ([]byte, error) {
+	stage, err := getHookStage(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hook := Hook{
+		Path: opts.HookPath,
+		Args: []string{"nvidia-container-toolkit", stage},
+	}
+	if len(opts.PathEnv) > 0 {
+		hook.Env = []string{"PATH=" + opts.PathEnv}
+	}
+
+	var config interface{}
+	switch opts.Format {
+	case hookFormatHooksD:
+		when, err := getHooksDWhen(opts)
+		if err != nil {
+			return nil, err
+		}
+		config = hooksDConfig{
+			Version: hooksDVersion,
+			Hook:    hook,
+			When:    when,
+			Stages:  []string{stage},
+		}
+	case hookFormatOCI:
+		if len(opts.Annotations) > 0 || len(opts.Commands) > 0 || opts.HasBindMounts {
+			return nil, fmt.Errorf("conditions are only supported by the %s format", hookFormatHooksD)
+		}
+		var hooks Hooks
+		*hooks.getStage(stage) = []Hook{hook}
+		config = hooks
+	default:
+		return nil, fmt.Errorf("unknown hook configuration format %q", opts.Format)
+	}
+
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func doGenerateHookConfig(args []string) {
+	defer exit()
+	log.SetFlags(0)
+
+	var opts hookConfigOptions
+	var output string
+
+	flags := flag.NewFlagSet("generate-hook-config", flag.ExitOnError)
+	flags.StringVar(&opts.Format, "format", hookFormatHooksD, "output format: 'hooks.d' (podman, CRI-O) or 'oci' (runtime spec hooks object)")
+	flags.StringVar(&opts.Stage, "stage", "", "hook stage (default: createRuntime if the runtime supports it, prestart otherwise)")
+	flags.StringVar(&opts.OCIVersion, "oci-version", "", "OCI runtime spec version implemented by the runtime")
+	flags.StringVar(&opts.HookPath, "hook-path", defaultHookPath, "path of the hook binary")
+	flags.StringVar(&opts.PathEnv, "path-env", strings.Join(defaultPATH, ":"), "PATH of the hook, empty to inherit it from the runtime")
+	flags.Var((*stringList)(&opts.Annotations), "annotation", "only run the hook for containers with an annotation matching KEY_REGEX=VALUE_REGEX (can be repeated)")
+	flags.Var((*stringList)(&opts.Commands), "command", "only run the hook for containers whose command matches the regex (can be repeated)")
+	flags.BoolVar(&opts.HasBindMounts, "has-bind-mounts", false, "only run the hook for containers with bind mounts")
+	flags.StringVar(&output, "output", "", "output file (default: stdout)")
+	flags.Parse(args)
+
+	config, err := generateHookConfig(&opts)
+	if err != nil {
+		log.Panicln("could not generate hook configuration:", err)
+	}
+
+	if len(output) == 0 {
+		os.Stdout.Write(config)
+		return
+	}
+	if err := ioutil.WriteFile(output, config, 0644); err != nil {
+		log.Panicln("could not write hook configuration:", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGenerateHookConfig(t *testing.T) {
+	var tests = []struct {
+		description   string
+		opts          hookConfigOptions
+		expected      string
+		expectedError bool
+	}{
+		{
+			description: "hooks.d, no conditions",
+			opts: hookConfigOptions{
+				Format:   hookFormatHooksD,
+				HookPath: defaultHookPath,
+				PathEnv:  "/usr/bin:/bin",
+			},
+			expected: `{
+    "version": "1.0.0",
+    "hook": {
+        "path": "/usr/bin/nvidia-container-toolkit",
+        "args": [
+            "nvidia-container-toolkit",
+            "prestart"
+        ],
+        "env": [
+            "PATH=/usr/bin:/bin"
+        ]
+    },
+    "when": {
+        "always": true
+    },
+    "stages": [
+        "prestart"
+    ]
+}
+`,
+		},
+		{
+			description: "hooks.d, annotation and bind mounts conditions, newer runtime",
+			opts: hookConfigOptions{
+				Format:        hookFormatHooksD,
+				OCIVersion:    "1.0.2",
+				HookPath:      "/opt/nvidia-container-toolkit",
+				Annotations:   []string{"^nvidia.com/gpu$=.+"},
+				HasBindMounts: true,
+			},
+			expected: `{
+    "version": "1.0.0",
+    "hook": {
+        "path": "/opt/nvidia-container-toolkit",
+        "args": [
+            "nvidia-container-toolkit",
+            "createRuntime"
+        ]
+    },
+    "when": {
+        "annotations": {
+            "^nvidia.com/gpu$": ".+"
+        },
+        "hasBindMounts": true
+    },
+    "stages": [
+        "createRuntime"
+    ]
+}
+`,
+		},
+		{
+			description: "OCI hooks, poststop",
+			opts: hookConfigOptions{
+				Format:   hookFormatOCI,
+				Stage:    stagePoststop,
+				HookPath: defaultHookPath,
+			},
+			expected: `{
+    "poststop": [
+        {
+            "path": "/usr/bin/nvidia-container-toolkit",
+            "args": [
+                "nvidia-container-toolkit",
+                "poststop"
+            ]
+        }
+    ]
+}
+`,
+		},
+		{
+			description: "Invalid command regex",
+			opts: hookConfigOptions{
+				Format:   hookFormatHooksD,
+				Commands: []string{"foo("},
+			},
+			expectedError: true,
+		},
+		{
+			description: "Invalid annotation condition",
+			opts: hookConfigOptions{
+				Format:      hookFormatHooksD,
+				Annotations: []string{"nvidia.com/gpu"},
+			},
+			expectedError: true,
+		},
+		{
+			description: "New stage on an older runtime",
+			opts: hookConfigOptions{
+				Format:     hookFormatHooksD,
+				Stage:      stageCreateRuntime,
+				OCIVersion: "1.0.1",
+			},
+			expectedError: true,
+		},
+		{
+			description: "startContainer stage",
+			opts: hookConfigOptions{
+				Format:     hookFormatOCI,
+				Stage:      stageStartContainer,
+				OCIVersion: "1.0.2",
+			},
+			expectedError: true,
+		},
+		{
+			description: "Unknown stage",
+			opts: hookConfigOptions{
+				Format: hookFormatHooksD,
+				Stage:  "foo",
+			},
+			expectedError: true,
+		},
+		{
+			description: "Conditions with the OCI format",
+			opts: hookConfigOptions{
+				Format:        hookFormatOCI,
+				HasBindMounts: true,
+			},
+			expectedError: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			config, err := generateHookConfig(&tc.opts)
+			if tc.expectedError {
+				if err == nil {
+					t.Errorf("Expected error, got %s", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(config) != tc.expected {
+				t.Errorf("Unexpected config (got: %s, wanted: %s)", config, tc.expected)
+			}
+		})
+	}
+}
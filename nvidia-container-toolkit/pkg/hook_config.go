@@ -34,20 +34,92 @@ type CLIConfig struct {
 
 // HookConfig : options for the nvidia-container-toolkit.
 type HookConfig struct {
-	DisableRequire                 bool    `toml:"disable-require"`
-	SwarmResource                  *string `toml:"swarm-resource"`
-	AcceptEnvvarUnprivileged       bool    `toml:"accept-nvidia-visible-devices-envvar-when-unprivileged"`
-	AcceptDeviceListAsVolumeMounts bool    `toml:"accept-nvidia-visible-devices-as-volume-mounts"`
+	DisableRequire                   bool     `toml:"disable-require"`
+	SwarmResource                    *string  `toml:"swarm-resource"`
+	AcceptEnvvarUnprivileged         bool     `toml:"accept-nvidia-visible-devices-envvar-when-unprivileged"`
+	AcceptDeviceListAsVolumeMounts   bool     `toml:"accept-nvidia-visible-devices-as-volume-mounts"`
+	AcceptCDIAnnotationsUnprivileged bool     `toml:"accept-cdi-annotations-when-unprivileged"`
+	AllowedRootfsPrefixes            []string `toml:"allowed-rootfs-prefixes"`
+	DisableRootlessAdjustments       bool     `toml:"disable-rootless-adjustments"`
+	StateDir                         string   `toml:"state-dir"`
+	Inventory                        string   `toml:"inventory"`
+	CDISpecDirs                      []string `toml:"cdi-spec-dirs"`
+	ProfileAnnotation                string   `toml:"profile-annotation"`
+	DefaultDevices                   string   `toml:"default-devices"`
 
-	NvidiaContainerCLI CLIConfig `toml:"nvidia-container-cli"`
+	Privilege              PrivilegeConfig          `toml:"privilege-policy"`
+	DriverCapabilities     CapabilityConfig         `toml:"driver-capabilities"`
+	CapabilityPolicy       CapabilityPolicyConfig   `toml:"capability-policy"`
+	Pools                  map[string]PoolConfig    `toml:"pools"`
+	Profiles               map[string]ProfileConfig `toml:"profiles"`
+	Facts                  FactsConfig              `toml:"host-facts"`
+	Requirements           RequirementsConfig       `toml:"requirements"`
+	LegacyImage            LegacyImageConfig        `toml:"legacy-cuda-image"`
+	Log                    LogConfig                `toml:"log"`
+	Audit                  AuditConfig              `toml:"audit"`
+	Metrics                MetricsConfig            `toml:"metrics"`
+	Verify                 VerifyConfig             `toml:"verify-injection"`
+	NvidiaContainerCLI     CLIConfig                `toml:"nvidia-container-cli"`
+	NvidiaContainerRuntime RuntimeConfig            `toml:"nvidia-container-runtime"`
 }
 
 func getDefaultHookConfig() (config HookConfig) {
 	return HookConfig{
-		DisableRequire:                 false,
-		SwarmResource:                  nil,
-		AcceptEnvvarUnprivileged:       true,
-		AcceptDeviceListAsVolumeMounts: false,
+		DisableRequire:                   false,
+		SwarmResource:                    nil,
+		AcceptEnvvarUnprivileged:         true,
+		AcceptDeviceListAsVolumeMounts:   false,
+		AcceptCDIAnnotationsUnprivileged: false,
+		AllowedRootfsPrefixes:            nil,
+		DisableRootlessAdjustments:       false,
+		StateDir:                         defaultStateDir,
+		Inventory:                        defaultInventoryPath,
+		CDISpecDirs:                      []string{defaultCDIStaticDir, defaultCDIDynamicDir},
+		ProfileAnnotation:                defaultProfileAnnotation,
+		DefaultDevices:                   defaultDevicesNone,
+		Privilege: PrivilegeConfig{
+			CapabilitySets:     []string{boundingCapabilitySet},
+			AllowUserNamespace: false,
+			TrustedAnnotations: nil,
+		},
+		DriverCapabilities: CapabilityConfig{
+			Registry:  nil,
+			OnUnknown: onUnknownCapabilityReject,
+		},
+		CapabilityPolicy: CapabilityPolicyConfig{
+			OnViolation: capabilityPolicyTrim,
+		},
+		Pools:    nil,
+		Profiles: nil,
+		Facts: FactsConfig{
+			ProcRoot: defaultProcRoot,
+			SysRoot:  defaultSysRoot,
+		},
+		Requirements: RequirementsConfig{
+			Enforce:   false,
+			Node:      nil,
+			OnFailure: requirementsOnFailureFail,
+		},
+		LegacyImage: LegacyImageConfig{
+			Devices:            legacyDevicesAll,
+			Capabilities:       legacyCapabilitiesAll,
+			AddCUDARequirement: true,
+		},
+		Log: LogConfig{
+			Level:  logLevelInfo,
+			Format: logFormatText,
+			Sinks:  []string{logSinkStderr},
+		},
+		Audit: AuditConfig{
+			Path: "",
+		},
+		Metrics: MetricsConfig{
+			Textfile: "",
+		},
+		Verify: VerifyConfig{
+			Enabled:   false,
+			OnFailure: verifyOnFailureWarn,
+		},
 		NvidiaContainerCLI: CLIConfig{
 			Root:        nil,
 			Path:        nil,
@@ -60,6 +132,13 @@ func getDefaultHookConfig() (config HookConfig) {
 			User:        nil,
 			Ldconfig:    nil,
 		},
+		NvidiaContainerRuntime: RuntimeConfig{
+			Debug:     nil,
+			Runtimes:  []string{"docker-runc", "runc"},
+			HookPath:  nil,
+			HookStage: stagePrestart,
+			Mode:      runtimeModeHook,
+		},
 	}
 }
 
@@ -84,5 +163,9 @@ func getHookConfig() (config HookConfig) {
 		}
 	}
 
+	if err := checkDefaultDevices(&config); err != nil {
+		log.Panicln("invalid configuration:", err)
+	}
+
 	return config
 }
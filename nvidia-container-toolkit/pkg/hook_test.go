@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -135,9 +137,198 @@ func TestIsPrivileged(t *testing.T) {
 	for _, tc := range tests {
 		var spec Spec
 		_ = json.Unmarshal([]byte(tc.spec), &spec)
-		privileged := isPrivileged(&spec)
+		hookConfig := getDefaultHookConfig()
+		privileged := getPrivilegeDecision(&hookConfig.Privilege, &spec).Privileged
 		if privileged != tc.expected {
 			t.Errorf("isPrivileged() returned unexpectred value (privileged: %v, tc.expected: %v)", privileged, tc.expected)
 		}
 	}
 }
+
+func TestDecodeSpec(t *testing.T) {
+	var tests = []struct {
+		description   string
+		spec          string
+		expectedPanic bool
+		userns        bool
+		annotations   map[string]string
+	}{
+		{
+			description: "Minimal spec",
+			spec: `
+			{
+				"ociVersion": "1.0.0",
+				"process": {},
+				"root": { "path": "rootfs" }
+			}
+			`,
+		},
+		{
+			description: "Spec with user namespace",
+			spec: `
+			{
+				"ociVersion": "1.1.0",
+				"process": { "user": { "uid": 1000, "gid": 1000 } },
+				"root": { "path": "rootfs" },
+				"linux": {
+					"namespaces": [ { "type": "pid" }, { "type": "user" } ]
+				}
+			}
+			`,
+			userns: true,
+		},
+		{
+			description: "Spec with uid mappings and annotations",
+			spec: `
+			{
+				"ociVersion": "1.2.0",
+				"process": {},
+				"root": { "path": "rootfs" },
+				"annotations": { "com.example.key": "value" },
+				"linux": {
+					"uidMappings": [ { "containerID": 0, "hostID": 100000, "size": 65536 } ],
+					"cgroupsPath": "/docker/abcd",
+					"mountLabel": "system_u:object_r:container_file_t:s0"
+				}
+			}
+			`,
+			userns:      true,
+			annotations: map[string]string{"com.example.key": "value"},
+		},
+		{
+			description: "Spec newer than the latest supported version",
+			spec: `
+			{
+				"ociVersion": "1.3.0",
+				"process": {},
+				"root": { "path": "rootfs" }
+			}
+			`,
+		},
+		{
+			description: "Spec older than the oldest supported version",
+			spec: `
+			{
+				"ociVersion": "0.6.0",
+				"process": {},
+				"root": { "path": "rootfs" }
+			}
+			`,
+			expectedPanic: true,
+		},
+		{
+			description: "Invalid version",
+			spec: `
+			{
+				"ociVersion": "foo",
+				"process": {},
+				"root": { "path": "rootfs" }
+			}
+			`,
+			expectedPanic: true,
+		},
+		{
+			description: "Missing version",
+			spec: `
+			{
+				"process": {},
+				"root": { "path": "rootfs" }
+			}
+			`,
+			expectedPanic: true,
+		},
+		{
+			description: "Missing root",
+			spec: `
+			{
+				"ociVersion": "1.0.0",
+				"process": {}
+			}
+			`,
+			expectedPanic: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			var spec *Spec
+			decode := func() {
+				spec = decodeSpec(strings.NewReader(tc.spec))
+			}
+
+			if tc.expectedPanic {
+				mustPanic(t, decode)
+				return
+			}
+
+			decode()
+			if spec.hasUserNamespace() != tc.userns {
+				t.Errorf("Unexpected user namespace (got: %v, wanted: %v)", spec.hasUserNamespace(), tc.userns)
+			}
+			if !reflect.DeepEqual(spec.Annotations, tc.annotations) {
+				t.Errorf("Unexpected annotations (got: %v, wanted: %v)", spec.Annotations, tc.annotations)
+			}
+		})
+	}
+}
+
+func TestGetHookState(t *testing.T) {
+	var tests = []struct {
+		description    string
+		state          string
+		expectedID     string
+		expectedBundle string
+		expectedPanic  bool
+	}{
+		{
+			description: "OCI state",
+			state: `
+			{
+				"ociVersion": "1.0.2",
+				"id": "abcd",
+				"status": "created",
+				"pid": 1234,
+				"bundle": "/run/bundle",
+				"annotations": { "com.example.key": "value" }
+			}
+			`,
+			expectedID:     "abcd",
+			expectedBundle: "/run/bundle",
+		},
+		{
+			description: "Legacy runc state",
+			state: `
+			{
+				"pid": 1234,
+				"bundlePath": "/run/bundle"
+			}
+			`,
+			expectedBundle: "/run/bundle",
+		},
+		{
+			description:   "Invalid state",
+			state:         `{ "pid": "foo" }`,
+			expectedPanic: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			var state HookState
+			getState := func() {
+				state = getHookState(strings.NewReader(tc.state))
+			}
+
+			if tc.expectedPanic {
+				mustPanic(t, getState)
+				return
+			}
+
+			getState()
+			if state.ID != tc.expectedID {
+				t.Errorf("Unexpected ID (got: %v, wanted: %v)", state.ID, tc.expectedID)
+			}
+			if state.getBundle() != tc.expectedBundle {
+				t.Errorf("Unexpected bundle (got: %v, wanted: %v)", state.getBundle(), tc.expectedBundle)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	defaultInventoryPath = "/etc/nvidia-container-runtime/inventory.toml"
+)
+
+// Inventory : the NVIDIA device nodes and driver files of the host. It is used
+// to inject GPUs without nvidia-container-cli, e.g. by editing OCI specs.
+type Inventory struct {
+	ControlDevices []InventoryDevice `toml:"control-devices"`
+	GPUs           []InventoryGPU    `toml:"gpus"`
+	Files          []InventoryFile   `toml:"files"`
+	Env            []string          `toml:"env"`
+	Hooks          []InventoryHook   `toml:"hooks"`
+}
+
+// InventoryDevice : a device node. The major and minor numbers are read from
+// the host device node when not set. Control devices listing capabilities
+// are only injected in containers requesting one of them.
+type InventoryDevice struct {
+	Path         string   `toml:"path"`
+	Major        *int64   `toml:"major"`
+	Minor        *int64   `toml:"minor"`
+	Capabilities []string `toml:"capabilities"`
+}
+
+// InventoryGPU : a GPU, its device nodes and its MIG devices. The
+// architecture (compute capability, e.g. "7.5") and brand are checked against
+// the requirements of the containers.
+type InventoryGPU struct {
+	Index   int                  `toml:"index"`
+	UUID    string               `toml:"uuid"`
+	Arch    string               `toml:"arch"`
+	Brand   string               `toml:"brand"`
+	Devices []InventoryDevice    `toml:"devices"`
+	MIG     []InventoryMIGDevice `toml:"mig"`
+}
+
+// InventoryMIGDevice : a MIG device and the device nodes giving access to it.
+// A MIG device can be selected as <gpu index>:<mig index> or by UUID.
+type InventoryMIGDevice struct {
+	Index   int               `toml:"index"`
+	UUID    string            `toml:"uuid"`
+	Devices []InventoryDevice `toml:"devices"`
+}
+
+// InventoryFile : a driver file, mounted in containers requesting one of its
+// capabilities (or in every GPU container if it lists none).
+type InventoryFile struct {
+	Path          string   `toml:"path"`
+	ContainerPath string   `toml:"container-path"`
+	Capabilities  []string `toml:"capabilities"`
+}
+
+// InventoryHook : an OCI hook run for containers requesting one of its
+// capabilities (or for every GPU container if it lists none).
+type InventoryHook struct {
+	HookName     string   `toml:"hook-name"`
+	Path         string   `toml:"path"`
+	Args         []string `toml:"args"`
+	Env          []string `toml:"env"`
+	Timeout      *int     `toml:"timeout"`
+	Capabilities []string `toml:"capabilities"`
+}
+
+func loadInventory(path string) (*Inventory, error) {
+	var inv Inventory
+	if _, err := toml.DecodeFile(path, &inv); err != nil {
+		return nil, fmt.Errorf("could not load inventory: %v", err)
+	}
+	return &inv, nil
+}
+
+func (d InventoryDevice) getNumbers() (major int64, minor int64, err error) {
+	if d.Major != nil && d.Minor != nil {
+		return *d.Major, *d.Minor, nil
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(d.Path, &st); err != nil {
+		return 0, 0, fmt.Errorf("could not stat %s: %v", d.Path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return 0, 0, fmt.Errorf("%s is not a character device", d.Path)
+	}
+	// Same encoding as the major() and minor() macros of glibc.
+	rdev := uint64(st.Rdev)
+	major = int64(((rdev >> 8) & 0xfff) | ((rdev >> 32) &^ 0xfff))
+	minor = int64((rdev & 0xff) | ((rdev >> 12) &^ 0xff))
+	return major, minor, nil
+}
+
+func (f InventoryFile) getContainerPath() string {
+	if len(f.ContainerPath) > 0 {
+		return f.ContainerPath
+	}
+	return f.Path
+}
+
+// hasAnyCapability returns true if the entry listing the given capabilities
+// applies to a container requesting caps.
+func hasAnyCapability(capabilities []string, caps []string) bool {
+	if len(capabilities) == 0 {
+		return true
+	}
+	for _, c := range caps {
+		if containsString(capabilities, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDevice returns the device nodes of a GPU or MIG device given by
+// index or UUID. A MIG device also needs the device nodes of its parent GPU.
+func (inv *Inventory) lookupDevice(name string) ([]InventoryDevice, bool) {
+	for _, gpu := range inv.GPUs {
+		if strconv.Itoa(gpu.Index) == name || gpu.UUID == name {
+			return gpu.Devices, true
+		}
+		for _, mig := range gpu.MIG {
+			if fmt.Sprintf("%d:%d", gpu.Index, mig.Index) == name || mig.UUID == name {
+				return append(append([]InventoryDevice{}, gpu.Devices...), mig.Devices...), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// getCanonicalDevice returns the name of a GPU or MIG device given by index
+// or UUID as "<gpu index>" or "<gpu index>:<mig index>".
+func (inv *Inventory) getCanonicalDevice(name string) (string, bool) {
+	for _, gpu := range inv.GPUs {
+		index := strconv.Itoa(gpu.Index)
+		if index == name || gpu.UUID == name {
+			return index, true
+		}
+		for _, mig := range gpu.MIG {
+			migIndex := fmt.Sprintf("%d:%d", gpu.Index, mig.Index)
+			if migIndex == name || mig.UUID == name {
+				return migIndex, true
+			}
+		}
+	}
+	return "", false
+}
+
+// getDeviceNodes returns the device nodes needed by a container requesting
+// the given devices and capabilities, without duplicates.
+func (inv *Inventory) getDeviceNodes(devices string, caps []string) ([]InventoryDevice, error) {
+	var nodes []InventoryDevice
+	for _, d := range inv.ControlDevices {
+		if hasAnyCapability(d.Capabilities, caps) {
+			nodes = append(nodes, d)
+		}
+	}
+
+	for _, name := range splitDeviceList(devices) {
+		if name == "all" {
+			for _, gpu := range inv.GPUs {
+				nodes = append(nodes, gpu.Devices...)
+			}
+			continue
+		}
+		found, ok := inv.lookupDevice(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown device %q", name)
+		}
+		nodes = append(nodes, found...)
+	}
+
+	var unique []InventoryDevice
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if !seen[n.Path] {
+			seen[n.Path] = true
+			unique = append(unique, n)
+		}
+	}
+	return unique, nil
+}
+
+// getFiles returns the driver files needed by a container requesting the
+// given capabilities.
+func (inv *Inventory) getFiles(caps []string) []InventoryFile {
+	var files []InventoryFile
+	for _, f := range inv.Files {
+		if hasAnyCapability(f.Capabilities, caps) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// getHooks returns the hooks needed by a container requesting the given
+// capabilities.
+func (inv *Inventory) getHooks(caps []string) []InventoryHook {
+	var hooks []InventoryHook
+	for _, h := range inv.Hooks {
+		if hasAnyCapability(h.Capabilities, caps) {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
+}
+
+func (inv *Inventory) lookupControlDevice(path string) (InventoryDevice, bool) {
+	for _, d := range inv.ControlDevices {
+		if d.Path == path {
+			return d, true
+		}
+	}
+	return InventoryDevice{}, false
+}
+
+func (inv *Inventory) lookupFile(path string) (InventoryFile, bool) {
+	for _, f := range inv.Files {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return InventoryFile{}, false
+}
+
+func (inv *Inventory) lookupHook(path string, args []string) (InventoryHook, bool) {
+	for _, h := range inv.Hooks {
+		if h.Path == path && reflect.DeepEqual(h.Args, args) {
+			return h, true
+		}
+	}
+	return InventoryHook{}, false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// A lease records that a container holds a device. Leases live in
+// <state-dir>/leases/<device>/<container-id>, so that finding the holders of a
+// device is a directory listing. A device may be held by several containers.
+// Leases change under <state-dir>/leases.lock.
+
+func getLeaseDir(stateDir string, device string) string {
+	return filepath.Join(stateDir, "leases", url.PathEscape(device))
+}
+
+func splitDeviceList(devices string) []string {
+	var list []string
+	for _, d := range strings.Split(devices, ",") {
+		if d = strings.TrimSpace(d); len(d) > 0 {
+			list = append(list, d)
+		}
+	}
+	return list
+}
+
+// lockLeases takes the lock on the leases, released by closing the returned
+// file.
+func lockLeases(stateDir string) (*os.File, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(stateDir, "leases.lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// acquireLeases creates a lease on each device for the given container and
+// returns the paths of the leases created so far. The caller holds the lock.
+func acquireLeases(stateDir string, id string, devices []string) ([]string, error) {
+	var leases []string
+	for _, device := range devices {
+		if device == "." || device == ".." {
+			return leases, fmt.Errorf("invalid device name %q", device)
+		}
+
+		dir := getLeaseDir(stateDir, device)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return leases, err
+		}
+
+		lease := filepath.Join(dir, id)
+		f, err := os.OpenFile(lease, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return leases, err
+		}
+		f.Close()
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// releaseLeases removes the given leases, and the directory of each device
+// no container holds anymore.
+func releaseLeases(stateDir string, leases []string) error {
+	if len(leases) == 0 {
+		return nil
+	}
+	lock, err := lockLeases(stateDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	for _, lease := range leases {
+		if err := removeIfExists(lease); err != nil {
+			return err
+		}
+		dir := filepath.Dir(lease)
+		if filepath.Dir(dir) != filepath.Join(stateDir, "leases") {
+			continue
+		}
+		holders, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && len(holders) == 0 {
+			if err := removeIfExists(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// Legacy CUDA images set CUDA_VERSION but none of the NVIDIA_* variables, see
+// isLegacyCUDAImage.
+const (
+	legacyDevicesAll  = "all"
+	legacyDevicesNone = "none"
+	poolDevicesPrefix = "pool:"
+
+	legacyCapabilitiesAll     = "all"
+	legacyCapabilitiesDefault = "default"
+)
+
+// LegacyImageConfig : defaults for legacy CUDA images. Devices is "all",
+// "none" or "pool:<name>" for the devices of a pool, capabilities is "all",
+// "default" or a list of capabilities, and add-cuda-requirement derives a
+// cuda>= requirement from CUDA_VERSION.
+type LegacyImageConfig struct {
+	Devices            string `toml:"devices"`
+	Capabilities       string `toml:"capabilities"`
+	AddCUDARequirement bool   `toml:"add-cuda-requirement"`
+}
+
+// getPoolDevices returns the device list of the pool.
+func getPoolDevices(pools map[string]PoolConfig, name string) string {
+	pool, ok := pools[name]
+	if !ok {
+		log.Panicf("unknown pool %q\n", name)
+	}
+	return strings.Join(pool.Devices, ",")
+}
+
+// getDevices returns the devices of legacy images not setting
+// NVIDIA_VISIBLE_DEVICES.
+func (c *LegacyImageConfig) getDevices(pools map[string]PoolConfig) *string {
+	var devices string
+	switch {
+	case c.Devices == legacyDevicesAll:
+		devices = "all"
+	case c.Devices == legacyDevicesNone:
+		devices = ""
+	case strings.HasPrefix(c.Devices, poolDevicesPrefix):
+		devices = getPoolDevices(pools, strings.TrimPrefix(c.Devices, poolDevicesPrefix))
+	default:
+		log.Panicf("invalid legacy image devices %q\n", c.Devices)
+	}
+	return &devices
+}
+
+// getCapabilities returns the capabilities of legacy images not setting
+// NVIDIA_DRIVER_CAPABILITIES.
+func (c *LegacyImageConfig) getCapabilities(allCapabilities string) *string {
+	capabilities := c.Capabilities
+	switch capabilities {
+	case legacyCapabilitiesAll:
+		capabilities = allCapabilities
+	case legacyCapabilitiesDefault:
+		capabilities = defaultDriverCapabilities
+	}
+	return &capabilities
+}
+
+// getLegacyImageDevices returns the default devices of the image if it is a
+// legacy image, nil otherwise.
+func getLegacyImageDevices(hook *HookConfig, env map[string]string) *string {
+	if !isLegacyCUDAImage(env) {
+		return nil
+	}
+	return hook.LegacyImage.getDevices(hook.Pools)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLegacyImageConfig(t *testing.T) {
+	env := map[string]string{envCUDAVersion: "10.2"}
+	pools := map[string]PoolConfig{
+		"legacy": {Devices: []string{"2", "3"}},
+	}
+
+	tests := []struct {
+		description    string
+		config         LegacyImageConfig
+		expectedConfig *nvidiaConfig
+		expectedPanic  bool
+	}{
+		{
+			description: "default",
+			config:      getDefaultHookConfig().LegacyImage,
+			expectedConfig: &nvidiaConfig{
+				Devices:            "all",
+				DriverCapabilities: allDriverCapabilities,
+				Requirements:       []string{"cuda>=10.2"},
+			},
+		},
+		{
+			description: "no devices, default capabilities, no requirement",
+			config: LegacyImageConfig{
+				Devices:      legacyDevicesNone,
+				Capabilities: legacyCapabilitiesDefault,
+			},
+			expectedConfig: &nvidiaConfig{
+				Devices:            "",
+				DriverCapabilities: defaultDriverCapabilities,
+			},
+		},
+		{
+			description: "pool devices, custom capabilities",
+			config: LegacyImageConfig{
+				Devices:            "pool:legacy",
+				Capabilities:       "compute,utility",
+				AddCUDARequirement: true,
+			},
+			expectedConfig: &nvidiaConfig{
+				Devices:            "2,3",
+				DriverCapabilities: "compute,utility",
+				Requirements:       []string{"cuda>=10.2"},
+			},
+		},
+		{
+			description: "unknown pool",
+			config: LegacyImageConfig{
+				Devices:      "pool:other",
+				Capabilities: legacyCapabilitiesAll,
+			},
+			expectedPanic: true,
+		},
+		{
+			description: "invalid devices",
+			config: LegacyImageConfig{
+				Devices:      "some",
+				Capabilities: legacyCapabilitiesAll,
+			},
+			expectedPanic: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			hook := getDefaultHookConfig()
+			hook.Pools = pools
+			hook.LegacyImage = tc.config
+
+			var config *nvidiaConfig
+			getConfig := func() {
+				config = getNvidiaConfig(&hook, env, nil, false)
+			}
+			if tc.expectedPanic {
+				mustPanic(t, getConfig)
+				return
+			}
+			getConfig()
+			if !reflect.DeepEqual(config, tc.expectedConfig) {
+				t.Errorf("Unexpected config: %+v", config)
+			}
+		})
+	}
+
+	// The image variables still win.
+	hook := getDefaultHookConfig()
+	hook.LegacyImage.Devices = legacyDevicesNone
+	config := getNvidiaConfig(&hook, map[string]string{envCUDAVersion: "10.2", envNVVisibleDevices: "0"}, nil, false)
+	if config.Devices != "0" {
+		t.Errorf("Unexpected devices: %q", config.Devices)
+	}
+}
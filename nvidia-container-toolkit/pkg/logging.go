@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	// Sinks are "stderr", "file:<path>", "syslog" for the local syslog daemon
+	// or "syslog:<socket>" for a unix datagram socket (e.g. journald's
+	// /run/systemd/journal/dev-log).
+	logSinkStderr       = "stderr"
+	logSinkFilePrefix   = "file:"
+	logSinkSyslog       = "syslog"
+	logSinkSyslogPrefix = "syslog:"
+
+	syslogTag = "nvidia-container-toolkit"
+)
+
+var logLevels = map[string]int{
+	logLevelDebug: 0,
+	logLevelInfo:  1,
+	logLevelWarn:  2,
+	logLevelError: 3,
+}
+
+// LogConfig : options for the logs of the hook and the runtime.
+type LogConfig struct {
+	Level  string   `toml:"level"`
+	Format string   `toml:"format"`
+	Sinks  []string `toml:"sinks"`
+}
+
+type logSink interface {
+	write(level string, line []byte) error
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) write(level string, line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s syslogSink) write(level string, line []byte) error {
+	msg := string(bytes.TrimSuffix(line, []byte("\n")))
+	switch level {
+	case logLevelDebug:
+		return s.w.Debug(msg)
+	case logLevelWarn:
+		return s.w.Warning(msg)
+	case logLevelError:
+		return s.w.Err(msg)
+	}
+	return s.w.Info(msg)
+}
+
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// structuredLogger writes leveled records, along with the fields of the
+// container, to its sinks. Once installed, it is the output of the standard
+// logger.
+type structuredLogger struct {
+	sync.Mutex
+	level  string
+	format string
+	sinks  []logSink
+	fields []logField
+	now    func() time.Time
+}
+
+var logger = newLogger()
+
+func newLogger() *structuredLogger {
+	return &structuredLogger{
+		level:  logLevelInfo,
+		format: logFormatText,
+		sinks:  []logSink{writerSink{os.Stderr}},
+		now:    time.Now,
+	}
+}
+
+func getLogSink(sink string) (logSink, error) {
+	switch {
+	case sink == logSinkStderr:
+		return writerSink{os.Stderr}, nil
+	case strings.HasPrefix(sink, logSinkFilePrefix):
+		f, err := os.OpenFile(strings.TrimPrefix(sink, logSinkFilePrefix), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return writerSink{f}, nil
+	case sink == logSinkSyslog:
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogTag)
+		if err != nil {
+			return nil, err
+		}
+		return syslogSink{w}, nil
+	case strings.HasPrefix(sink, logSinkSyslogPrefix):
+		w, err := syslog.Dial("unixgram", strings.TrimPrefix(sink, logSinkSyslogPrefix), syslog.LOG_DAEMON|syslog.LOG_INFO, syslogTag)
+		if err != nil {
+			return nil, err
+		}
+		return syslogSink{w}, nil
+	}
+	return nil, fmt.Errorf("unknown log sink %q", sink)
+}
+
+// configure applies the configuration, the debug flag forcing the debug
+// level. Sinks that cannot be opened are skipped, logging must not prevent
+// containers from starting. Without any sink, records go to stderr so that
+// errors, such as why a container was refused, are not lost.
+func (l *structuredLogger) configure(config *LogConfig, debug bool) error {
+	if _, ok := logLevels[config.Level]; !ok {
+		return fmt.Errorf("unknown log level %q", config.Level)
+	}
+	if config.Format != logFormatText && config.Format != logFormatJSON {
+		return fmt.Errorf("unknown log format %q", config.Format)
+	}
+
+	var sinks []logSink
+	var errs []string
+	for _, s := range config.Sinks {
+		sink, err := getLogSink(s)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, writerSink{os.Stderr})
+	}
+
+	l.Lock()
+	l.level = config.Level
+	if debug {
+		l.level = logLevelDebug
+	}
+	l.format = config.Format
+	l.sinks = sinks
+	l.Unlock()
+
+	for _, err := range errs {
+		l.log(logLevelWarn, "could not open log sink: "+err)
+	}
+	return nil
+}
+
+func (l *structuredLogger) addSink(sink logSink) {
+	l.Lock()
+	defer l.Unlock()
+	l.sinks = append(l.sinks, sink)
+}
+
+// setField sets a field of all the following records.
+func (l *structuredLogger) setField(key string, value interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	for i := range l.fields {
+		if l.fields[i].Key == key {
+			l.fields[i].Value = value
+			return
+		}
+	}
+	l.fields = append(l.fields, logField{key, value})
+}
+
+func (l *structuredLogger) isDebug() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.level == logLevelDebug
+}
+
+func formatTextValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if len(s) == 0 || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatRecord returns the record as a line, in logfmt for the text format.
+func (l *structuredLogger) formatRecord(level string, msg string) []byte {
+	t := l.now().UTC().Format(time.RFC3339Nano)
+	var buf bytes.Buffer
+	if l.format == logFormatJSON {
+		buf.WriteByte('{')
+		field := func(key string, value interface{}) {
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(value)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(value))
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(v)
+		}
+		field("time", t)
+		field("level", level)
+		field("msg", msg)
+		for _, f := range l.fields {
+			field(f.Key, f.Value)
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(&buf, "time=%s level=%s msg=%s", t, level, formatTextValue(msg))
+	for _, f := range l.fields {
+		fmt.Fprintf(&buf, " %s=%s", f.Key, formatTextValue(f.Value))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func (l *structuredLogger) log(level string, msg string) {
+	l.Lock()
+	defer l.Unlock()
+	if logLevels[level] < logLevels[l.level] {
+		return
+	}
+	line := l.formatRecord(level, strings.TrimSuffix(msg, "\n"))
+	for _, s := range l.sinks {
+		// Nowhere to report it.
+		_ = s.write(level, line)
+	}
+}
+
+// getStdLogLevel returns the level of a line of the standard logger: the
+// messages of log.Panic* and log.Fatal* are errors, others are info.
+func getStdLogLevel() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		f, more := frames.Next()
+		if strings.HasPrefix(f.Function, "log.") {
+			name := f.Function[strings.LastIndex(f.Function, ".")+1:]
+			if strings.HasPrefix(name, "Panic") || strings.HasPrefix(name, "Fatal") {
+				return logLevelError
+			}
+		}
+		if !more {
+			return logLevelInfo
+		}
+	}
+}
+
+// Write makes the logger the output of the standard logger.
+func (l *structuredLogger) Write(p []byte) (int, error) {
+	l.log(getStdLogLevel(), string(p))
+	return len(p), nil
+}
+
+// installLogger makes the standard logger write records.
+func installLogger() {
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(logger)
+}
+
+// configureLogger installs the logger with the given configuration.
+func configureLogger(config *LogConfig) {
+	installLogger()
+	if err := logger.configure(config, *debugflag); err != nil {
+		log.Panicln("invalid log configuration:", err)
+	}
+}
+
+func logDebug(v ...interface{}) {
+	logger.log(logLevelDebug, fmt.Sprintln(v...))
+}
+
+func logWarn(v ...interface{}) {
+	logger.log(logLevelWarn, fmt.Sprintln(v...))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getTestLogger(format string, level string) (*structuredLogger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := newLogger()
+	l.format = format
+	l.level = level
+	l.sinks = []logSink{writerSink{&buf}}
+	l.now = func() time.Time {
+		return time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	}
+	return l, &buf
+}
+
+func TestLoggerFormats(t *testing.T) {
+	l, buf := getTestLogger(logFormatText, logLevelInfo)
+	l.setField("container-id", "abc")
+	l.setField("devices", "0,1")
+	l.log(logLevelInfo, "could not open file\n")
+	l.log(logLevelDebug, "not logged")
+	l.setField("devices", "2")
+	l.log(logLevelWarn, "done")
+
+	expected := `time=2020-10-01T12:00:00Z level=info msg="could not open file" container-id=abc devices=0,1
+time=2020-10-01T12:00:00Z level=warn msg=done container-id=abc devices=2
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+
+	l, buf = getTestLogger(logFormatJSON, logLevelDebug)
+	l.setField("pid", 42)
+	l.log(logLevelDebug, `a "quoted" message`)
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if record["level"] != logLevelDebug || record["msg"] != `a "quoted" message` || record["pid"] != float64(42) {
+		t.Errorf("Unexpected record: %v", record)
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":"2020-10-01T12:00:00Z","level":"debug"`) {
+		t.Errorf("Unexpected field order: %s", buf.String())
+	}
+}
+
+func TestStdLoggerLevels(t *testing.T) {
+	l, buf := getTestLogger(logFormatText, logLevelInfo)
+	log.SetOutput(l)
+	defer log.SetOutput(os.Stderr)
+
+	log.Println("info message")
+	mustPanic(t, func() {
+		log.Panicln("error message")
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "level=info") || !strings.Contains(lines[1], "level=error") {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestLoggerSinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "logging-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	socket := filepath.Join(tmp, "dev-log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	file := filepath.Join(tmp, "hook.log")
+	l := newLogger()
+	config := LogConfig{
+		Level:  logLevelWarn,
+		Format: logFormatJSON,
+		Sinks:  []string{logSinkFilePrefix + file, logSinkSyslogPrefix + socket},
+	}
+	if err := l.configure(&config, false); err != nil {
+		t.Fatal(err)
+	}
+	l.log(logLevelInfo, "dropped")
+	l.log(logLevelError, "failed")
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil || !strings.Contains(string(data), `"msg":"failed"`) || strings.Contains(string(data), "dropped") {
+		t.Errorf("Unexpected log file %q: %v", data, err)
+	}
+
+	msg := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LOG_DAEMON|LOG_ERR
+	if !strings.HasPrefix(string(msg[:n]), "<27>") || !strings.Contains(string(msg[:n]), `"msg":"failed"`) {
+		t.Errorf("Unexpected syslog message %q", msg[:n])
+	}
+
+	// The debug flag wins over the configured level.
+	if err := l.configure(&config, true); err != nil || !l.isDebug() {
+		t.Errorf("Expected the debug level: %v", err)
+	}
+	config.Format = "xml"
+	if err := l.configure(&config, false); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestLoggerFallbackSink(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "logging-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	stderr, err := os.Create(filepath.Join(tmp, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	saved := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = saved }()
+
+	for _, sinks := range [][]string{{logSinkFilePrefix + filepath.Join(tmp, "missing/hook.log")}, {}} {
+		l := newLogger()
+		config := LogConfig{Level: logLevelInfo, Format: logFormatText, Sinks: sinks}
+		if err := l.configure(&config, false); err != nil {
+			t.Fatal(err)
+		}
+		l.log(logLevelError, fmt.Sprintf("refused with %d sinks", len(sinks)))
+	}
+
+	data, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"could not open log sink", "refused with 1 sinks", "refused with 0 sinks"} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected %q on stderr:\n%s", expected, data)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -14,11 +13,13 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	debugflag  = flag.Bool("debug", true, "enable debug output")
+	debugflag  = flag.Bool("debug", false, "enable debug output, whatever the log level of the configuration")
 	configflag = flag.String("config", "", "configuration file")
+	dryrunflag = flag.Bool("dry-run", false, "print what the prestart hook would do instead of doing it")
 
 	defaultPATH = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
 )
@@ -28,8 +29,8 @@ func exit() {
 		if _, ok := err.(runtime.Error); ok {
 			log.Println(err)
 		}
-		if *debugflag {
-			log.Printf("%s", debug.Stack())
+		if *debugflag || logger.isDebug() {
+			logDebug(string(debug.Stack()))
 		}
 		os.Exit(1)
 	}
@@ -69,34 +70,123 @@ func getCLIPath(config CLIConfig) string {
 	return path
 }
 
-// getRootfsPath returns an absolute path. We don't need to resolve symlinks for now.
-func getRootfsPath(config containerConfig) string {
-	rootfs, err := filepath.Abs(config.Rootfs)
+// setLogContainerID adds the ID of the container the hook runs for to every
+// log record, including the panic message reported by exit().
+func setLogContainerID(id string) {
+	installLogger()
+	if len(id) > 0 {
+		logger.setField("container-id", id)
+	}
+}
+
+// getDebugLogPath expands the {id} placeholder of the debug log path with the
+// container ID, giving each container its own debug log.
+func getDebugLogPath(debug string, id string) string {
+	if !validContainerID.MatchString(id) {
+		id = "unknown"
+	}
+	return strings.Replace(debug, "{id}", id, -1)
+}
+
+// getRootfsPath returns the absolute path of the rootfs, resolved against the
+// bundle directory and with all symlinks evaluated.
+func getRootfsPath(hook HookConfig, config containerConfig) string {
+	rootfs, err := resolveRootfs(config.Bundle, config.Rootfs, hook.AllowedRootfsPrefixes)
 	if err != nil {
-		log.Panicln(err)
+		log.Panicln("invalid rootfs:", err)
 	}
 	return rootfs
 }
 
+// runCLI runs nvidia-container-cli as a child of the hook, rather than
+// exec'ing it, and returns its exit code.
+func runCLI(args []string, env []string) (int, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
 func doPrestart() {
 	var err error
 
+	start := time.Now()
 	defer exit()
 	log.SetFlags(0)
 
+	state := getHookState(os.Stdin)
+	setLogContainerID(state.ID)
+
 	hook := getHookConfig()
+	configureLogger(&hook.Log)
 	cli := hook.NvidiaContainerCLI
 
+	metrics := prestartMetrics{Start: start}
+	if !*dryrunflag {
+		defer func() {
+			err := recover()
+			if err != nil {
+				metrics.Outcome = auditOutcomeFailed
+				metrics.DeniedReason = deniedReason
+			}
+			writeMetrics(hook.Metrics, &metrics)
+			if err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	//查询容器的配置参数
-	container := getContainerConfig(hook)
+	container := getContainerConfig(hook, state)
 	//获取GPU相关的配置参数
 	nvidia := container.Nvidia
+	if !*dryrunflag {
+		defer func() {
+			if err := recover(); err != nil {
+				record := getAssignmentRecord(&container)
+				record.Outcome = auditOutcomeFailed
+				record.Reason = strings.TrimSpace(fmt.Sprint(err))
+				writeAuditRecord(hook.Audit, record)
+				panic(err)
+			}
+		}()
+	}
 	if nvidia == nil {
-		// Not a GPU container, nothing to do.
+		// Not a GPU container, nothing to do but recording the devices the
+		// runtime injected.
+		metrics.Outcome = prestartOutcomeSkipped
+		if container.DeviceSource == deviceSourceAnnotation && !*dryrunflag {
+			recordAssignment(&hook, &container, nil)
+			record := getAssignmentRecord(&container)
+			record.Outcome = auditOutcomeAssigned
+			writeAuditRecord(hook.Audit, record)
+			metrics.Outcome = auditOutcomeAssigned
+			metrics.Devices = record.Devices
+		}
 		return
 	}
+	logger.setField("pid", container.Pid)
+	logger.setField("bundle", container.Bundle)
+	logger.setField("devices", nvidia.Devices)
+	logger.setField("capabilities", nvidia.DriverCapabilities)
+	if cdi, _ := splitCDIDevices(nvidia.Devices); len(cdi) > 0 {
+		log.Panicln("CDI devices must be injected by nvidia-container-runtime or a CDI-enabled runtime:", strings.Join(cdi, ","))
+	}
+
+	rootfs := getRootfsPath(hook, container)
 
-	rootfs := getRootfsPath(container)
+	if !hook.DisableRootlessAdjustments {
+		user := getUserContext()
+		cli = adjustCLIConfig(cli, user, container)
+		if user.isRootless() {
+			checkRootlessDeviceAccess(nvidiactlPath)
+		}
+	}
 
 	//获取 nvidia-container-cli 的安装路径，将路径放在[]string{}切片args中
 	args := []string{getCLIPath(cli)}
@@ -112,10 +202,15 @@ func doPrestart() {
 	if cli.NoPivot {
 		args = append(args, "--no-pivot")
 	}
-	if *debugflag {
+	var files []string
+	if logger.isDebug() {
 		args = append(args, "--debug=/dev/stderr")
 	} else if cli.Debug != nil {
-		args = append(args, fmt.Sprintf("--debug=%s", *cli.Debug))
+		debugLog := getDebugLogPath(*cli.Debug, container.ID)
+		if debugLog != *cli.Debug {
+			files = append(files, debugLog)
+		}
+		args = append(args, fmt.Sprintf("--debug=%s", debugLog))
 	}
 	if cli.Ldcache != nil {
 		args = append(args, fmt.Sprintf("--ldcache=%s", *cli.Ldcache))
@@ -133,16 +228,6 @@ func doPrestart() {
 	}
 	//将设置的GPU 环境变量或者挂载转变为device
 	if len(nvidia.Devices) > 0 {
-		log.Println("nvidia.Devices:",nvidia.Devices)
-		log.Println("args for cli:",args)
-		//time.Sleep(1*time.Minute)
-		//nvidia.Devices = "GPU-3c31cd14-a562-c0d4-5f1f-dce6374e4577"
-		//nvidia.Devices = "1"
-		file,_ := os.OpenFile("/usr/bin/gpu.config",os.O_RDWR|os.O_CREATE,0755)
-		data,_ := ioutil.ReadAll(file)
-		gpus := string(data)
-		gpus = strings.Replace(gpus, "\n", "", -1)
-		nvidia.Devices = gpus
 		args = append(args, fmt.Sprintf("--device=%s", nvidia.Devices))
 	}
 	//mig 配置
@@ -153,42 +238,160 @@ func doPrestart() {
 		args = append(args, fmt.Sprintf("--mig-monitor=%s", nvidia.MigMonitorDevices))
 	}
 
-	for _, cap := range strings.Split(nvidia.DriverCapabilities, ",") {
-		if len(cap) == 0 {
-			break
-		}
-		args = append(args, capabilityToCLI(cap))
+	for _, c := range nvidia.Capabilities {
+		args = append(args, c.Flag)
 	}
 
+	facts := getHostFacts(&hook)
+	// An image newer than the host driver may bring its own driver libraries,
+	// the requirements are then checked against them.
+	compat, compatErr := getCUDACompat(rootfs, container.Env, nvidia.Requirements, &facts)
+	if compat != nil {
+		facts.CUDAVersion = compat.CUDAVersion
+	}
+	var requireErr error
 	if !hook.DisableRequire && !nvidia.DisableRequire {
-		for _, req := range nvidia.Requirements {
-			args = append(args, fmt.Sprintf("--require=%s", req))
+		// Fail early with a clear message, anything we cannot tell is left to
+		// nvidia-container-cli.
+		requireErr = compatErr
+		if requireErr == nil {
+			_, requireErr = checkRequirements(nvidia.Requirements, &facts, nvidia.Devices)
+		}
+		if requireErr != nil && !*dryrunflag {
+			metrics.RequirementFailed = true
+			switch hook.Requirements.OnFailure {
+			case requirementsOnFailureWarn:
+				logWarn(requireErr)
+			case requirementsOnFailureFail:
+				deny(deniedReasonRequirements, requireErr)
+			default:
+				log.Panicln("unknown requirement failure policy:", hook.Requirements.OnFailure)
+			}
+		}
+		// nvidia-container-cli would check them against the host driver, and
+		// fail on them.
+		if compat == nil && hook.Requirements.OnFailure != requirementsOnFailureWarn {
+			for _, req := range nvidia.Requirements {
+				args = append(args, fmt.Sprintf("--require=%s", req))
+			}
 		}
 	}
 
 	args = append(args, fmt.Sprintf("--pid=%s", strconv.FormatUint(uint64(container.Pid), 10)))
 	args = append(args, rootfs)
 
+	if *dryrunflag {
+		printDryRun(os.Stdout, &facts, &container, args, compat, requireErr)
+		return
+	}
+
+	if compat != nil {
+		if err := enableCUDACompat(rootfs); err != nil {
+			log.Panicln("could not enable the CUDA compat libraries:", err)
+		}
+		log.Printf("using the CUDA %s compat libraries of the image (%s)\n", compat.CUDAVersion, compat.LibCUDAVersion)
+	}
+
+	recordAssignment(&hook, &container, files)
+
+	// The assignment is only recorded once nvidia-container-cli succeeded,
+	// failures being recorded by the deferred function.
+	assigned := getAssignmentRecord(&container)
+	assigned.Outcome = auditOutcomeAssigned
+	if requireErr != nil {
+		assigned.Reason = requireErr.Error()
+	}
+
 	//至此，参数构建完毕
 	//获取原有环境变量
-	//os.Setenv("NVIDIA_VISIBLE_DEVICES","1")
 	env := append(os.Environ(), cli.Environment...)
 	//args[0]为nvidia-container-cli的路径，相当于执行该命令，在参数args、env下
 	///usr/bin/nvidia-container-cli  --load-kmods  --debug=/var/log/nvidia-container-toolkit.log  configure --ldconfig=@/sbin/ldconfig --device=all --compute --utility  --pid=78717  /var/lib/docker/overlay2/6ac97e95475e9df0f32f7e2f7251ca053651c62292d1a5127c71d33e55904d2b/merged
+	// Both the metrics and the audit log need the outcome of
+	// nvidia-container-cli, it is otherwise exec'ed.
+	if len(hook.Metrics.Textfile) > 0 || len(hook.Audit.Path) > 0 {
+		code, err := runCLI(args, env)
+		if err != nil {
+			log.Panicln("could not run nvidia-container-cli:", err)
+		}
+		metrics.CLIExitCode = &code
+		if code != 0 {
+			log.Panicf("nvidia-container-cli failed with exit code %d\n", code)
+		}
+		writeAuditRecord(hook.Audit, assigned)
+		metrics.Outcome = auditOutcomeAssigned
+		metrics.Devices = nvidia.Devices
+		return
+	}
 	err = syscall.Exec(args[0], args, env)
 	log.Panicln("exec failed:", err)
 }
 
+// doVerify runs the in-container checks. Where the container root can be found
+// depends on the stage: createContainer hooks run in the container mount
+// namespace before pivot_root and poststart hooks run in the runtime
+// namespace.
+func doVerify(stage string) {
+	defer exit()
+	log.SetFlags(0)
+
+	state := getHookState(os.Stdin)
+	setLogContainerID(state.ID)
+
+	hook := getHookConfig()
+	configureLogger(&hook.Log)
+	if !hook.Verify.Enabled {
+		return
+	}
+
+	var root string
+	var pid int
+	switch stage {
+	case stageCreateContainer:
+		s := loadSpec(path.Join(state.getBundle(), "config.json"))
+		root = getRootfsPath(hook, containerConfig{Bundle: state.getBundle(), Rootfs: s.Root.Path})
+	default:
+		root = fmt.Sprintf("/proc/%d/root", state.Pid)
+		pid = state.Pid
+	}
+	verifyContainer(&hook, state.ID, root, pid)
+}
+
+func doPoststop() {
+	defer exit()
+	log.SetFlags(0)
+
+	state := getHookState(os.Stdin)
+	setLogContainerID(state.ID)
+
+	hook := getHookConfig()
+	configureLogger(&hook.Log)
+	if err := releaseContainer(&hook, state.ID); err != nil {
+		log.Panicln("could not release container:", err)
+	}
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\nCommands:\n")
-	fmt.Fprintf(os.Stderr, "  prestart\n        run the prestart hook\n")
-	fmt.Fprintf(os.Stderr, "  poststart\n        no-op\n")
-	fmt.Fprintf(os.Stderr, "  poststop\n        no-op\n")
+	fmt.Fprintf(os.Stderr, "  prestart, createRuntime\n        inject GPUs in the container\n")
+	fmt.Fprintf(os.Stderr, "  createContainer, poststart\n        verify that GPUs were injected, if enabled\n")
+	fmt.Fprintf(os.Stderr, "  poststop\n        release what the prestart hook recorded for the container\n")
+	fmt.Fprintf(os.Stderr, "  generate-hook-config\n        print the hook configuration for podman, CRI-O or config.json\n")
+	fmt.Fprintf(os.Stderr, "  modify-spec [-inventory FILE] BUNDLE|CONFIG_JSON\n        inject GPUs straight into an OCI spec\n")
+	fmt.Fprintf(os.Stderr, "  cdi generate [-inventory FILE] [-format yaml|json] [-output FILE]\n        generate a CDI spec for the GPUs of the inventory\n")
+	fmt.Fprintf(os.Stderr, "  configure-runtime [-runtime containerd|docker|crio] [-set-as-default] [-dry-run]\n        register the nvidia runtime (or hook) in the configuration of a container engine\n")
+	fmt.Fprintf(os.Stderr, "  doctor\n        print the host facts and check the setup\n")
+	fmt.Fprintf(os.Stderr, "  runtime [RUNTIME ARGS]\n        wrap the low-level runtime, adding the hooks to GPU containers (also run as %s)\n", runtimeBinaryName)
 }
 
 func main() {
+	// When installed as the runtime, the arguments are the ones of runc.
+	if filepath.Base(os.Args[0]) == runtimeBinaryName {
+		doRuntime(os.Args[1:])
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -200,13 +403,32 @@ func main() {
 
 	// 走 prestart 流程
 	switch args[0] {
-	case "prestart":
+	case stagePrestart, stageCreateRuntime:
 		doPrestart()
 		os.Exit(0)
-	case "poststart":
-		fallthrough
-	case "poststop":
+	case stageCreateContainer, stagePoststart:
+		doVerify(args[0])
+		os.Exit(0)
+	case stagePoststop:
+		doPoststop()
+		os.Exit(0)
+	case "generate-hook-config":
+		doGenerateHookConfig(args[1:])
+		os.Exit(0)
+	case "modify-spec":
+		doModifySpec(args[1:])
+		os.Exit(0)
+	case "cdi":
+		doCDI(args[1:])
+		os.Exit(0)
+	case "configure-runtime":
+		doConfigureRuntime(args[1:])
+		os.Exit(0)
+	case "doctor":
+		doDoctor()
 		os.Exit(0)
+	case "runtime":
+		doRuntime(args[1:])
 	default:
 		flag.Usage()
 		os.Exit(2)
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The hook is too short-lived to be scraped, it updates a file for the
+// textfile collector of the node exporter instead. The file holds the
+// cumulated values, it is read, updated and atomically replaced under a lock.
+
+const (
+	metricsPrefix = "nvidia_container_toolkit_"
+
+	metricPrestart           = metricsPrefix + "prestart_total"
+	metricPrestartDuration   = metricsPrefix + "prestart_duration_seconds"
+	metricCLIExitCodes       = metricsPrefix + "cli_exit_codes_total"
+	metricRequirementFailure = metricsPrefix + "requirement_failures_total"
+	metricDenied             = metricsPrefix + "denied_total"
+	metricGPUAssignments     = metricsPrefix + "gpu_assignments_total"
+
+	metricTypeCounter   = "counter"
+	metricTypeHistogram = "histogram"
+
+	prestartOutcomeSkipped = "skipped"
+)
+
+// Why the hook refused the request of a container.
+const (
+	deniedReasonPrivileges       = "privileges"
+	deniedReasonCapabilityPolicy = "capability-policy"
+	deniedReasonCapability       = "unknown-capability"
+	deniedReasonProfile          = "unknown-profile"
+	deniedReasonRequirements     = "requirements"
+)
+
+// MetricsConfig : options for the Prometheus metrics. Metrics are written to
+// the textfile (e.g.
+// /var/lib/node_exporter/textfile_collector/nvidia_container_toolkit.prom),
+// if set. nvidia-container-cli then runs as a child of the hook, to get its
+// exit code, rather than replacing it: the hook lives as long as
+// nvidia-container-cli, and signals sent to the hook do not reach it.
+type MetricsConfig struct {
+	Textfile string `toml:"textfile"`
+}
+
+type metricFamily struct {
+	Name string
+	Type string
+	Help string
+}
+
+var metricFamilies = []metricFamily{
+	{metricPrestart, metricTypeCounter, "Prestart hook invocations by outcome."},
+	{metricPrestartDuration, metricTypeHistogram, "Duration of the prestart hook, including nvidia-container-cli."},
+	{metricCLIExitCodes, metricTypeCounter, "nvidia-container-cli runs by exit code."},
+	{metricRequirementFailure, metricTypeCounter, "Containers with unsatisfied requirements."},
+	{metricDenied, metricTypeCounter, "Containers denied GPUs by reason."},
+	{metricGPUAssignments, metricTypeCounter, "GPU assignments by device."},
+}
+
+var prestartDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// deniedReason is why the hook refused the request of the container, if it
+// did.
+var deniedReason string
+
+// deny fails the hook, recording the reason of the denial.
+func deny(reason string, v ...interface{}) {
+	deniedReason = reason
+	log.Panicln(v...)
+}
+
+// prestartMetrics : what a prestart hook invocation reports.
+type prestartMetrics struct {
+	Start             time.Time
+	Outcome           string
+	CLIExitCode       *int
+	RequirementFailed bool
+	DeniedReason      string
+	Devices           string
+}
+
+// metricsFile holds the samples of the textfile, by series (name and labels).
+type metricsFile map[string]float64
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// getSeries returns the series of the metric with the given label pairs.
+func getSeries(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabelValue(labels[i+1])))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m metricsFile) inc(name string, labels ...string) {
+	m[getSeries(name, labels...)]++
+}
+
+func (m metricsFile) observe(name string, buckets []float64, v float64) {
+	// All the buckets are exposed, even empty.
+	for _, b := range buckets {
+		series := getSeries(name+"_bucket", "le", formatFloat(b))
+		if v <= b {
+			m[series]++
+		} else {
+			m[series] += 0
+		}
+	}
+	m.inc(name+"_bucket", "le", "+Inf")
+	m[name+"_sum"] += v
+	m.inc(name + "_count")
+}
+
+// parseMetricsFile reads the samples of a textfile we wrote. Timestamps are
+// not supported.
+func parseMetricsFile(data []byte) (metricsFile, error) {
+	m := make(metricsFile)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid sample %q", line)
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample %q", line)
+		}
+		m[line[:i]] = v
+	}
+	return m, scanner.Err()
+}
+
+// getSeriesFamily returns the family of the series, and its rank in the
+// family: histogram buckets by bound, then the sum and the count.
+func getSeriesFamily(series string) (string, int, float64) {
+	name := series
+	if i := strings.Index(series, "{"); i >= 0 {
+		name = series[:i]
+	}
+	for _, f := range metricFamilies {
+		if f.Type != metricTypeHistogram {
+			continue
+		}
+		switch name {
+		case f.Name + "_bucket":
+			var le float64
+			if i := strings.Index(series, `le="`); i >= 0 {
+				v := series[i+len(`le="`):]
+				// ParseFloat understands "+Inf".
+				le, _ = strconv.ParseFloat(v[:strings.Index(v, `"`)], 64)
+			}
+			return f.Name, 0, le
+		case f.Name + "_sum":
+			return f.Name, 1, 0
+		case f.Name + "_count":
+			return f.Name, 2, 0
+		}
+	}
+	return name, 0, 0
+}
+
+// format returns the textfile, the series of each family being together.
+func (m metricsFile) format() []byte {
+	series := make([]string, 0, len(m))
+	for s := range m {
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		fi, ki, li := getSeriesFamily(series[i])
+		fj, kj, lj := getSeriesFamily(series[j])
+		switch {
+		case fi != fj:
+			return fi < fj
+		case ki != kj:
+			return ki < kj
+		case li != lj:
+			return li < lj
+		}
+		return series[i] < series[j]
+	})
+
+	families := make(map[string]metricFamily)
+	for _, f := range metricFamilies {
+		families[f.Name] = f
+	}
+
+	var buf bytes.Buffer
+	last := ""
+	for _, s := range series {
+		name, _, _ := getSeriesFamily(s)
+		if f, ok := families[name]; ok && name != last {
+			fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.Name, f.Help, f.Name, f.Type)
+		}
+		last = name
+		fmt.Fprintf(&buf, "%s %s\n", s, formatFloat(m[s]))
+	}
+	return buf.Bytes()
+}
+
+func (p *prestartMetrics) update(m metricsFile, now time.Time) {
+	m.inc(metricPrestart, "outcome", p.Outcome)
+	m.observe(metricPrestartDuration, prestartDurationBuckets, now.Sub(p.Start).Seconds())
+	if p.CLIExitCode != nil {
+		m.inc(metricCLIExitCodes, "code", strconv.Itoa(*p.CLIExitCode))
+	}
+	if p.RequirementFailed {
+		m.inc(metricRequirementFailure)
+	}
+	if len(p.DeniedReason) > 0 {
+		m.inc(metricDenied, "reason", p.DeniedReason)
+	}
+	for _, d := range splitDeviceList(p.Devices) {
+		m.inc(metricGPUAssignments, "device", d)
+	}
+}
+
+// writeMetrics adds the metrics of the invocation to the textfile, if
+// enabled. Failing to do so must not prevent the container from starting, so
+// errors are only logged.
+func writeMetrics(config MetricsConfig, p *prestartMetrics) {
+	if len(config.Textfile) == 0 {
+		return
+	}
+	if err := updateMetricsFile(config.Textfile, p, time.Now()); err != nil {
+		logWarn("could not update metrics:", err)
+	}
+}
+
+func updateMetricsFile(path string, p *prestartMetrics, now time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// The textfile is replaced, the lock is a separate file.
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	m := make(metricsFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if m, err = parseMetricsFile(data); err != nil {
+			return err
+		}
+	}
+
+	p.update(m, now)
+	return writeFileAtomic(path, m.format(), 0644)
+}
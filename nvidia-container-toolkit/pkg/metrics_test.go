@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateMetricsFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "textfile", "nvidia_container_toolkit.prom")
+
+	start := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	code := 0
+	assigned := prestartMetrics{
+		Start:       start,
+		Outcome:     auditOutcomeAssigned,
+		CLIExitCode: &code,
+		Devices:     "0,1",
+	}
+	denied := prestartMetrics{
+		Start:             start,
+		Outcome:           auditOutcomeFailed,
+		RequirementFailed: true,
+		DeniedReason:      deniedReasonRequirements,
+	}
+	for _, u := range []struct {
+		metrics  *prestartMetrics
+		duration time.Duration
+	}{
+		{&assigned, 200 * time.Millisecond},
+		{&assigned, 3 * time.Second},
+		{&denied, 20 * time.Millisecond},
+	} {
+		if err := updateMetricsFile(path, u.metrics, start.Add(u.duration)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseMetricsFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		`nvidia_container_toolkit_prestart_total{outcome="assigned"}`:          2,
+		`nvidia_container_toolkit_prestart_total{outcome="failed"}`:            1,
+		`nvidia_container_toolkit_cli_exit_codes_total{code="0"}`:              2,
+		`nvidia_container_toolkit_requirement_failures_total`:                  1,
+		`nvidia_container_toolkit_denied_total{reason="requirements"}`:         1,
+		`nvidia_container_toolkit_gpu_assignments_total{device="1"}`:           2,
+		`nvidia_container_toolkit_prestart_duration_seconds_bucket{le="0.01"}`: 0,
+		`nvidia_container_toolkit_prestart_duration_seconds_bucket{le="0.25"}`: 2,
+		`nvidia_container_toolkit_prestart_duration_seconds_bucket{le="5"}`:    3,
+		`nvidia_container_toolkit_prestart_duration_seconds_bucket{le="+Inf"}`: 3,
+		`nvidia_container_toolkit_prestart_duration_seconds_count`:             3,
+	}
+	for series, v := range expected {
+		if m[series] != v {
+			t.Errorf("Unexpected value %v for %s", m[series], series)
+		}
+	}
+	if sum := m["nvidia_container_toolkit_prestart_duration_seconds_sum"]; sum < 3.219 || sum > 3.221 {
+		t.Errorf("Unexpected duration sum %v", sum)
+	}
+
+	// Each family is announced once, its series following, the buckets of
+	// the histogram by bound.
+	text := string(data)
+	if strings.Count(text, "# TYPE nvidia_container_toolkit_prestart_duration_seconds histogram") != 1 {
+		t.Errorf("Unexpected textfile:\n%s", text)
+	}
+	histogram := text[strings.Index(text, "# TYPE nvidia_container_toolkit_prestart_duration_seconds"):]
+	order := []string{`le="0.01"`, `le="0.1"`, `le="1"`, `le="10"`, `le="+Inf"`, "_sum", "_count", "# HELP"}
+	last := 0
+	for _, o := range order {
+		i := strings.Index(histogram, o)
+		if i < last {
+			t.Errorf("Unexpected position of %s in:\n%s", o, histogram)
+		}
+		last = i
+	}
+}
+
+func TestDeny(t *testing.T) {
+	defer func() { deniedReason = "" }()
+	mustPanic(t, func() {
+		deny(deniedReasonPrivileges, "insufficient privileges")
+	})
+	if deniedReason != deniedReasonPrivileges {
+		t.Errorf("Unexpected reason %q", deniedReason)
+	}
+}
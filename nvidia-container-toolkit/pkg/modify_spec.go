@@ -0,0 +1,295 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	runtimeModeHook       = "hook"
+	runtimeModeModifySpec = "modify-spec"
+)
+
+// Options of the driver files mounted in containers.
+var driverFileMountOptions = []string{"ro", "nosuid", "nodev", "bind"}
+
+func setEnv(env []string, key string, value string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+// editSpec injects GPUs straight into the spec, as an alternative to the
+// hooks: it adds the device nodes, their device cgroup rules, the driver file
+// mounts, the hooks and the environment from the inventory. It returns the
+// audit record of the assignment, or nil if the container does not get any
+// GPUs.
+//
+// Requirements are checked against the host driver, the CUDA compat libraries
+// of the image are not used in this mode. There is no container ID nor
+// poststop hook either, so devices are not leased, no container state is
+// recorded and the injection is not verified.
+func editSpec(hook *HookConfig, inv *Inventory, spec *Spec) (*auditRecord, error) {
+	envSwarmGPU = hook.SwarmResource
+	env := getEnvMap(spec.Process.Env)
+	privileged := getPrivilegeDecision(&hook.Privilege, spec).Privileged
+	profile := getProfile(hook, spec.Annotations)
+	nvidia := getNvidiaConfig(hook, env, spec.Mounts, privileged)
+	defaultDevices := nvidia == nil && usesDefaultDevices(hook, profile, env, spec.Mounts)
+	if nvidia != nil || defaultDevices {
+		checkProfile(hook, profile)
+	}
+	source := getDeviceSource(hook, env, spec.Mounts)
+	if defaultDevices {
+		policy := getDefaultDevicesPolicy(hook, profile)
+		if policy == defaultDevicesFirstFree {
+			// There is no container ID to lease a device for, nor a poststop
+			// hook to release it.
+			return nil, fmt.Errorf("%q default devices are not supported when editing the spec", policy)
+		}
+		devices, err := getDefaultDevices(hook, policy, "", false)
+		if err != nil {
+			return nil, err
+		}
+		nvidia = getNvidiaConfigForDevices(hook, env, devices, privileged, false)
+		source = deviceSourceDefault
+	}
+	if nvidia == nil {
+		return nil, nil
+	}
+	nvidia.Capabilities = applyCapabilityPolicy(hook, nvidia, privileged, profile)
+	nvidia.DriverCapabilities = getCapabilityNames(nvidia.Capabilities)
+	caps := strings.Split(nvidia.DriverCapabilities, ",")
+
+	container := containerConfig{
+		Privileged:   privileged,
+		Profile:      profile,
+		DeviceSource: source,
+		Nvidia:       nvidia,
+	}
+	record := getAssignmentRecord(&container)
+	record.Outcome = auditOutcomeAssigned
+
+	if !hook.DisableRequire && !nvidia.DisableRequire {
+		facts := getHostFacts(hook)
+		facts.GPUs = getGPUFacts(inv)
+		// There is no nvidia-container-cli to check what we cannot tell.
+		if _, err := checkRequirements(nvidia.Requirements, &facts, nvidia.Devices); err != nil {
+			switch hook.Requirements.OnFailure {
+			case requirementsOnFailureWarn:
+				logWarn(err)
+				record.Reason = err.Error()
+			case requirementsOnFailureFail:
+				deny(deniedReasonRequirements, err)
+			default:
+				log.Panicln("unknown requirement failure policy:", hook.Requirements.OnFailure)
+			}
+		}
+	}
+
+	nodes, err := inv.getDeviceNodes(nvidia.Devices, caps)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		major, minor, err := node.getNumbers()
+		if err != nil {
+			return nil, err
+		}
+		addLinuxDevice(spec, node.Path, major, minor, "rwm")
+	}
+
+	for _, f := range inv.getFiles(caps) {
+		if hasMount(spec.Mounts, f.getContainerPath()) {
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, Mount{
+			Destination: f.getContainerPath(),
+			Type:        "bind",
+			Source:      f.Path,
+			Options:     driverFileMountOptions,
+		})
+	}
+
+	for _, h := range inv.getHooks(caps) {
+		if !addHook(spec, h.HookName, Hook{Path: h.Path, Args: h.Args, Env: h.Env, Timeout: h.Timeout}) {
+			return nil, fmt.Errorf("unknown hook stage %q in inventory", h.HookName)
+		}
+	}
+
+	for _, e := range inv.Env {
+		p := strings.SplitN(e, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid environment variable in inventory: %q", e)
+		}
+		spec.Process.Env = setEnv(spec.Process.Env, p[0], p[1])
+	}
+
+	// The GPUs are now part of the spec, make sure no hook injects them again.
+	spec.Process.Env = setEnv(spec.Process.Env, envNVVisibleDevices, "void")
+	if envSwarmGPU != nil {
+		spec.Process.Env = setEnv(spec.Process.Env, *envSwarmGPU, "void")
+	}
+
+	return &record, nil
+}
+
+// addLinuxDevice adds a device node to the spec, along with the device cgroup
+// rule allowing it. Either is only added if not already there, so that the
+// spec can be edited again.
+func addLinuxDevice(spec *Spec, path string, major int64, minor int64, access string) {
+	if spec.Linux == nil {
+		spec.Linux = &Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &LinuxResources{}
+	}
+	if !hasLinuxDevice(spec.Linux.Devices, path) {
+		mode := os.FileMode(0666)
+		spec.Linux.Devices = append(spec.Linux.Devices, LinuxDevice{
+			Path:     path,
+			Type:     "c",
+			Major:    major,
+			Minor:    minor,
+			FileMode: &mode,
+		})
+	}
+	if !hasLinuxDeviceCgroup(spec.Linux.Resources.Devices, major, minor, access) {
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   "c",
+			Major:  &major,
+			Minor:  &minor,
+			Access: access,
+		})
+	}
+}
+
+func hasLinuxDeviceCgroup(rules []LinuxDeviceCgroup, major int64, minor int64, access string) bool {
+	for _, r := range rules {
+		if r.Allow && r.Type == "c" && r.Major != nil && *r.Major == major && r.Minor != nil && *r.Minor == minor && r.Access == access {
+			return true
+		}
+	}
+	return false
+}
+
+// addHook adds a hook to the given stage of the spec, unless a hook with the
+// same path and arguments is already there. It returns false for an unknown
+// stage.
+func addHook(spec *Spec, stage string, hook Hook) bool {
+	if spec.Hooks == nil {
+		spec.Hooks = &Hooks{}
+	}
+	hooks := spec.Hooks.getStage(stage)
+	if hooks == nil {
+		return false
+	}
+	for _, h := range *hooks {
+		if h.Path == hook.Path && reflect.DeepEqual(h.Args, hook.Args) {
+			return true
+		}
+	}
+	*hooks = append(*hooks, hook)
+	return true
+}
+
+func hasLinuxDevice(devices []LinuxDevice, path string) bool {
+	for _, d := range devices {
+		if d.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMount(mounts []Mount, destination string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Destination) == filepath.Clean(destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifySpec injects the CDI devices and then the inventory devices requested
+// by the container, returning false if it does not get any, along with the
+// audit record of the inventory devices.
+func modifySpec(hook *HookConfig, inventoryPath string, spec *Spec) (bool, *auditRecord) {
+	modified, err := injectCDIDevices(hook, spec)
+	if err != nil {
+		log.Panicln("could not inject CDI devices:", err)
+	}
+	if !requestsGPUs(hook, spec) {
+		return modified, nil
+	}
+
+	inv, err := loadInventory(inventoryPath)
+	if err != nil {
+		log.Panicln(err)
+	}
+	assigned, err := editSpec(hook, inv, spec)
+	if err != nil {
+		log.Panicln("could not inject GPUs in OCI spec:", err)
+	}
+	return modified || assigned != nil, assigned
+}
+
+// modifySpecFile edits the given config.json, returning false if the container
+// does not get any GPUs. The assignment is recorded once the spec is written.
+func modifySpecFile(hook *HookConfig, inventoryPath string, specPath string) bool {
+	spec, raw, err := readSpecFile(specPath)
+	if err != nil {
+		log.Panicln("could not read OCI spec:", err)
+	}
+	modified, assigned := modifySpec(hook, inventoryPath, spec)
+	if !modified {
+		return false
+	}
+	if err := writeSpecFile(specPath, raw, spec); err != nil {
+		log.Panicln("could not write OCI spec:", err)
+	}
+	if assigned != nil {
+		assigned.Bundle = filepath.Dir(specPath)
+		writeAuditRecord(hook.Audit, *assigned)
+	}
+	return true
+}
+
+func doModifySpec(args []string) {
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	configureLogger(&hook.Log)
+
+	flags := flag.NewFlagSet("modify-spec", flag.ExitOnError)
+	inventory := flags.String("inventory", hook.Inventory, "inventory of the NVIDIA devices and driver files")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s modify-spec [-inventory FILE] BUNDLE|CONFIG_JSON\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	specPath := flags.Arg(0)
+	if info, err := os.Stat(specPath); err == nil && info.IsDir() {
+		specPath = filepath.Join(specPath, "config.json")
+	}
+	if !modifySpecFile(&hook, *inventory, specPath) {
+		log.Println("not a GPU container, nothing to do")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+const testInventory = `
+env = ["NVIDIA_DRIVER_VERSION=450.80.02"]
+
+[[control-devices]]
+path = "/dev/nvidiactl"
+major = 195
+minor = 255
+
+[[control-devices]]
+path = "/dev/nvidia-uvm"
+major = 235
+minor = 0
+capabilities = ["compute"]
+
+[[gpus]]
+index = 0
+uuid = "GPU-0"
+devices = [{path = "/dev/nvidia0", major = 195, minor = 0}]
+
+[[gpus]]
+index = 1
+uuid = "GPU-1"
+devices = [{path = "/dev/nvidia1", major = 195, minor = 1}]
+
+  [[gpus.mig]]
+  index = 0
+  uuid = "MIG-GPU-1/0/0"
+  devices = [{path = "/dev/nvidia-caps/nvidia-cap12", major = 237, minor = 12}]
+
+[[files]]
+path = "/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02"
+capabilities = ["utility"]
+
+[[files]]
+path = "/usr/lib/x86_64-linux-gnu/libcuda.so.450.80.02"
+capabilities = ["compute"]
+
+[[files]]
+path = "/usr/bin/nvidia-smi"
+container-path = "/usr/local/bin/nvidia-smi"
+
+[[hooks]]
+hook-name = "createContainer"
+path = "/usr/bin/nvidia-ldconfig-hook"
+args = ["nvidia-ldconfig-hook", "/usr/lib/x86_64-linux-gnu"]
+capabilities = ["compute"]
+`
+
+func getTestInventory(t *testing.T) *Inventory {
+	var inv Inventory
+	if _, err := toml.Decode(testInventory, &inv); err != nil {
+		t.Fatal(err)
+	}
+	return &inv
+}
+
+func getTestSpec(env []string) *Spec {
+	return &Spec{
+		Process: &Process{Env: env},
+		Root:    &Root{Path: "rootfs"},
+	}
+}
+
+func getDevicePaths(s *Spec) (paths []string) {
+	for _, d := range s.Linux.Devices {
+		paths = append(paths, d.Path)
+	}
+	return paths
+}
+
+func getMountDestinations(s *Spec) (destinations []string) {
+	for _, m := range s.Mounts {
+		destinations = append(destinations, m.Destination)
+	}
+	return destinations
+}
+
+func TestGetDeviceNodes(t *testing.T) {
+	inv := getTestInventory(t)
+
+	tests := []struct {
+		description string
+		devices     string
+		caps        []string
+		expected    []string
+		fail        bool
+	}{
+		{"Index", "0", []string{"utility"}, []string{"/dev/nvidiactl", "/dev/nvidia0"}, false},
+		{"UUID with compute", "GPU-1", []string{"compute"}, []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia1"}, false},
+		{"All", "all", []string{"utility"}, []string{"/dev/nvidiactl", "/dev/nvidia0", "/dev/nvidia1"}, false},
+		{"MIG by index", "1:0", []string{"utility"}, []string{"/dev/nvidiactl", "/dev/nvidia1", "/dev/nvidia-caps/nvidia-cap12"}, false},
+		{"MIG by UUID and parent", "MIG-GPU-1/0/0,1", []string{"utility"}, []string{"/dev/nvidiactl", "/dev/nvidia1", "/dev/nvidia-caps/nvidia-cap12"}, false},
+		{"Unknown device", "2", []string{"utility"}, nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			nodes, err := inv.getDeviceNodes(tc.devices, tc.caps)
+			if tc.fail {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, n := range nodes {
+				paths = append(paths, n.Path)
+			}
+			if !reflect.DeepEqual(paths, tc.expected) {
+				t.Errorf("Unexpected device nodes: %v", paths)
+			}
+		})
+	}
+}
+
+func TestEditSpec(t *testing.T) {
+	inv := getTestInventory(t)
+	hook := getDefaultHookConfig()
+
+	spec := getTestSpec([]string{"NVIDIA_VISIBLE_DEVICES=1", "NVIDIA_DRIVER_CAPABILITIES=compute,utility"})
+	spec.Mounts = []Mount{{Destination: "/usr/local/bin/nvidia-smi", Source: "/opt/nvidia-smi", Type: "bind"}}
+	spec.Linux = &Linux{Devices: []LinuxDevice{{Path: "/dev/nvidiactl", Type: "c", Major: 195, Minor: 255}}}
+
+	assigned, err := editSpec(&hook, inv, spec)
+	if err != nil || assigned == nil {
+		t.Fatal("Could not edit spec:", err)
+	}
+	privileged := false
+	expectedRecord := auditRecord{Event: auditEventAssigned, Devices: "1", Capabilities: "compute,utility", DeviceSource: deviceSourceEnv, Privileged: &privileged, Outcome: auditOutcomeAssigned}
+	if !reflect.DeepEqual(*assigned, expectedRecord) {
+		t.Errorf("Unexpected audit record (got: %+v, wanted: %+v)", *assigned, expectedRecord)
+	}
+
+	expectedDevices := []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia1"}
+	if !reflect.DeepEqual(getDevicePaths(spec), expectedDevices) {
+		t.Errorf("Unexpected devices: %v", getDevicePaths(spec))
+	}
+
+	var rules []string
+	for _, r := range spec.Linux.Resources.Devices {
+		rules = append(rules, fmt.Sprintf("%s %d:%d %s", r.Type, *r.Major, *r.Minor, r.Access))
+	}
+	expectedRules := []string{"c 195:255 rwm", "c 235:0 rwm", "c 195:1 rwm"}
+	if !reflect.DeepEqual(rules, expectedRules) {
+		t.Errorf("Unexpected device cgroup rules: %v", rules)
+	}
+
+	expectedMounts := []string{
+		"/usr/local/bin/nvidia-smi",
+		"/usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.80.02",
+		"/usr/lib/x86_64-linux-gnu/libcuda.so.450.80.02",
+	}
+	if !reflect.DeepEqual(getMountDestinations(spec), expectedMounts) {
+		t.Errorf("Unexpected mounts: %v", getMountDestinations(spec))
+	}
+	if !reflect.DeepEqual(spec.Mounts[1].Options, []string{"ro", "nosuid", "nodev", "bind"}) {
+		t.Errorf("Unexpected mount options: %v", spec.Mounts[1].Options)
+	}
+
+	if spec.Hooks == nil || len(spec.Hooks.CreateContainer) != 1 || spec.Hooks.CreateContainer[0].Path != "/usr/bin/nvidia-ldconfig-hook" {
+		t.Errorf("Unexpected hooks: %+v", spec.Hooks)
+	}
+
+	env := getEnvMap(spec.Process.Env)
+	if env["NVIDIA_VISIBLE_DEVICES"] != "void" || env["NVIDIA_DRIVER_VERSION"] != "450.80.02" {
+		t.Errorf("Unexpected environment: %v", spec.Process.Env)
+	}
+
+	// The container no longer requests GPUs, editing it again is a no-op.
+	assigned, err = editSpec(&hook, inv, spec)
+	if err != nil || assigned != nil {
+		t.Errorf("Expected the spec to be left untouched: %v", err)
+	}
+}
+
+func TestEditSpecTwice(t *testing.T) {
+	inv := getTestInventory(t)
+	hook := getDefaultHookConfig()
+
+	// As when the runtime wrapper and then modify-spec edit the same spec.
+	spec := getTestSpec([]string{"NVIDIA_VISIBLE_DEVICES=0", "NVIDIA_DRIVER_CAPABILITIES=compute"})
+	var edited []string
+	for i := 0; i < 2; i++ {
+		spec.Process.Env = setEnv(spec.Process.Env, envNVVisibleDevices, "0")
+		if assigned, err := editSpec(&hook, inv, spec); err != nil || assigned == nil {
+			t.Fatal("Could not edit spec:", err)
+		}
+		data, err := json.Marshal(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edited = append(edited, string(data))
+	}
+	if edited[0] != edited[1] {
+		t.Errorf("Editing the spec again changed it (got: %s, wanted: %s)", edited[1], edited[0])
+	}
+}
+
+func TestEditSpecNoGPU(t *testing.T) {
+	inv := getTestInventory(t)
+	hook := getDefaultHookConfig()
+
+	spec := getTestSpec([]string{"PATH=/usr/bin"})
+	assigned, err := editSpec(&hook, inv, spec)
+	if err != nil || assigned != nil || spec.Linux != nil {
+		t.Errorf("Expected the spec to be left untouched: %v", err)
+	}
+
+	// Unknown profiles only matter to GPU containers.
+	spec.Annotations = map[string]string{defaultProfileAnnotation: "training"}
+	if requestsGPUs(&hook, spec) {
+		t.Error("Unexpected GPU request")
+	}
+	if assigned, err := editSpec(&hook, inv, spec); err != nil || assigned != nil {
+		t.Errorf("Expected the spec to be left untouched: %v", err)
+	}
+	spec.Process.Env = append(spec.Process.Env, envNVVisibleDevices+"=0")
+	mustPanic(t, func() {
+		editSpec(&hook, inv, spec)
+	})
+}
+
+func TestEditSpecRequirements(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "modify-spec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeFixture(t, filepath.Join(tmp, "proc/driver/nvidia/version"), "NVRM version: NVIDIA UNIX x86_64 Kernel Module  450.80.02  Wed Sep 23 01:13:39 UTC 2020\n")
+
+	inv := getTestInventory(t)
+	hook := getDefaultHookConfig()
+	hook.Facts = FactsConfig{ProcRoot: filepath.Join(tmp, "proc"), SysRoot: filepath.Join(tmp, "sys")}
+	driverRoot := filepath.Join(tmp, "driver")
+	hook.NvidiaContainerCLI.Root = &driverRoot
+	hook.Inventory = filepath.Join(tmp, "inventory.toml")
+
+	tests := []struct {
+		description string
+		env         []string
+		onFailure   string
+		reason      string
+		fail        bool
+	}{
+		{"Satisfied", []string{"NVIDIA_REQUIRE_DRIVER=driver>=450"}, requirementsOnFailureFail, "", false},
+		{"Unknown", []string{"NVIDIA_REQUIRE_ARCH=arch>=8.0"}, requirementsOnFailureFail, "", false},
+		{"Unsatisfied", []string{"NVIDIA_REQUIRE_CUDA=cuda>=12.0"}, requirementsOnFailureFail, "", true},
+		{"Unsatisfied with warn", []string{"NVIDIA_REQUIRE_CUDA=cuda>=12.0"}, requirementsOnFailureWarn, "unsatisfied requirement", false},
+		{"Disabled", []string{"NVIDIA_REQUIRE_CUDA=cuda>=12.0", "NVIDIA_DISABLE_REQUIRE=true"}, requirementsOnFailureFail, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			hook.Requirements.OnFailure = tc.onFailure
+			spec := getTestSpec(append([]string{"NVIDIA_VISIBLE_DEVICES=0"}, tc.env...))
+			if tc.fail {
+				mustPanic(t, func() {
+					editSpec(&hook, inv, spec)
+				})
+				if spec.Linux != nil {
+					t.Error("Expected the spec to be left untouched")
+				}
+				return
+			}
+			assigned, err := editSpec(&hook, inv, spec)
+			if err != nil || assigned == nil {
+				t.Fatal("Could not edit spec:", err)
+			}
+			if !strings.HasPrefix(assigned.Reason, tc.reason) || (len(tc.reason) == 0 && len(assigned.Reason) > 0) {
+				t.Errorf("Unexpected reason: %q", assigned.Reason)
+			}
+		})
+	}
+}
+
+func TestModifySpecFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "modify-spec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	inventoryPath := filepath.Join(tmp, "inventory.toml")
+	if err := ioutil.WriteFile(inventoryPath, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	specPath := filepath.Join(tmp, "config.json")
+	config := `{"ociVersion": "1.0.2", "process": {"env": ["NVIDIA_VISIBLE_DEVICES=0"], "user": {"uid": 0, "gid": 0}, "args": ["sh"]}, "root": {"path": "rootfs"}, "linux": {"namespaces": [{"type": "mount"}]}}`
+	if err := ioutil.WriteFile(specPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := getDefaultHookConfig()
+	hook.Audit.Path = filepath.Join(tmp, "audit.jsonl")
+	if !modifySpecFile(&hook, inventoryPath, specPath) {
+		t.Fatal("Expected the spec to be modified")
+	}
+
+	audit, err := ioutil.ReadFile(hook.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry auditRecord
+	if err := json.Unmarshal(audit, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Event != auditEventAssigned || entry.Outcome != auditOutcomeAssigned || entry.Bundle != tmp || entry.Devices != "0" {
+		t.Errorf("Unexpected audit record: %+v", entry)
+	}
+
+	spec, raw, err := readSpecFile(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(getDevicePaths(spec), []string{"/dev/nvidiactl", "/dev/nvidia0"}) {
+		t.Errorf("Unexpected devices: %v", getDevicePaths(spec))
+	}
+	var process struct {
+		Process struct {
+			Args []string `json:"args"`
+		} `json:"process"`
+	}
+	if err := json.Unmarshal(raw, &process); err != nil || !reflect.DeepEqual(process.Process.Args, []string{"sh"}) {
+		t.Errorf("Unknown fields were not preserved: %s", raw)
+	}
+	if len(spec.Linux.Namespaces) != 1 {
+		t.Errorf("Namespaces were not preserved: %v", spec.Linux.Namespaces)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const (
+	boundingCapabilitySet  = "bounding"
+	effectiveCapabilitySet = "effective"
+	permittedCapabilitySet = "permitted"
+)
+
+// PrivilegeConfig : policy deciding whether a container is privileged.
+type PrivilegeConfig struct {
+	CapabilitySets     []string `toml:"capability-sets"`
+	AllowUserNamespace bool     `toml:"allow-user-namespace"`
+	TrustedAnnotations []string `toml:"trusted-annotations"`
+}
+
+type privilegeDecision struct {
+	Privileged bool
+	Reasons    []string
+}
+
+func (d *privilegeDecision) addReason(format string, a ...interface{}) {
+	d.Reasons = append(d.Reasons, fmt.Sprintf(format, a...))
+}
+
+func getCapabilitySet(lc *LinuxCapabilities, set string) []string {
+	switch set {
+	case boundingCapabilitySet:
+		return lc.Bounding
+	case effectiveCapabilitySet:
+		return lc.Effective
+	case permittedCapabilitySet:
+		return lc.Permitted
+	default:
+		log.Panicln("unknown capability set in privilege policy:", set)
+	}
+	return nil
+}
+
+// getPrivilegeDecision decides whether the container is privileged. This
+// controls access to MIG devices and whether NVIDIA_VISIBLE_DEVICES is trusted.
+//
+// A container is privileged if one of the trusted annotations is set to true.
+// Otherwise, every capability set listed in the policy must hold CAP_SYS_ADMIN
+// and, unless allowed, the container must not run in a user namespace since
+// its capabilities would then only apply inside that namespace.
+func getPrivilegeDecision(policy *PrivilegeConfig, s *Spec) (d privilegeDecision) {
+	for _, key := range policy.TrustedAnnotations {
+		value, ok := s.Annotations[key]
+		if !ok {
+			continue
+		}
+		if trusted, _ := strconv.ParseBool(value); trusted {
+			d.Privileged = true
+			d.addReason("trusted annotation %s=%s", key, value)
+			return
+		}
+	}
+
+	if len(policy.CapabilitySets) == 0 {
+		log.Panicln("no capability sets in privilege policy")
+	}
+
+	lc := s.getCapabilities()
+	if lc == nil {
+		d.addReason("no capabilities in OCI spec")
+		return
+	}
+	for _, set := range policy.CapabilitySets {
+		if !containsString(getCapabilitySet(lc, set), capSysAdmin) {
+			d.addReason("%s capability set lacks %s", set, capSysAdmin)
+			return
+		}
+		d.addReason("%s capability set has %s", set, capSysAdmin)
+	}
+
+	if s.hasUserNamespace() {
+		if !policy.AllowUserNamespace {
+			d.addReason("capabilities are confined to a user namespace")
+			return
+		}
+		d.addReason("user namespace allowed by policy")
+	}
+
+	d.Privileged = true
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
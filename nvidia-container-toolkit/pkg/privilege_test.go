@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetPrivilegeDecision(t *testing.T) {
+	const (
+		sysAdminEverywhere = `
+		{
+			"ociVersion": "1.0.0",
+			"root": { "path": "rootfs" },
+			"process": {
+				"capabilities": {
+					"bounding": [ "CAP_SYS_ADMIN" ],
+					"effective": [ "CAP_SYS_ADMIN" ]
+				}
+			}
+		}
+		`
+		sysAdminBoundingOnly = `
+		{
+			"ociVersion": "1.0.0",
+			"root": { "path": "rootfs" },
+			"process": {
+				"capabilities": {
+					"bounding": [ "CAP_SYS_ADMIN" ],
+					"effective": [ "CAP_CHOWN" ]
+				}
+			}
+		}
+		`
+		sysAdminUserNamespace = `
+		{
+			"ociVersion": "1.0.0",
+			"root": { "path": "rootfs" },
+			"process": {
+				"capabilities": {
+					"bounding": [ "CAP_SYS_ADMIN" ],
+					"effective": [ "CAP_SYS_ADMIN" ]
+				}
+			},
+			"linux": {
+				"namespaces": [ { "type": "user" } ]
+			}
+		}
+		`
+		trustedAnnotation = `
+		{
+			"ociVersion": "1.0.0",
+			"root": { "path": "rootfs" },
+			"process": {},
+			"annotations": { "example.com/gpu-admin": "true" }
+		}
+		`
+	)
+
+	var tests = []struct {
+		description   string
+		spec          string
+		policy        PrivilegeConfig
+		expected      bool
+		expectedPanic bool
+	}{
+		{
+			description: "Bounding set required, bounding set has CAP_SYS_ADMIN",
+			spec:        sysAdminBoundingOnly,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding"}},
+			expected:    true,
+		},
+		{
+			description: "Effective set required, effective set lacks CAP_SYS_ADMIN",
+			spec:        sysAdminBoundingOnly,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding", "effective"}},
+			expected:    false,
+		},
+		{
+			description: "Effective set required, effective set has CAP_SYS_ADMIN",
+			spec:        sysAdminEverywhere,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding", "effective"}},
+			expected:    true,
+		},
+		{
+			description: "User namespace, not allowed",
+			spec:        sysAdminUserNamespace,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding"}},
+			expected:    false,
+		},
+		{
+			description: "User namespace, allowed",
+			spec:        sysAdminUserNamespace,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding"}, AllowUserNamespace: true},
+			expected:    true,
+		},
+		{
+			description: "Trusted annotation set",
+			spec:        trustedAnnotation,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding"}, TrustedAnnotations: []string{"example.com/gpu-admin"}},
+			expected:    true,
+		},
+		{
+			description: "Annotation set but not trusted",
+			spec:        trustedAnnotation,
+			policy:      PrivilegeConfig{CapabilitySets: []string{"bounding"}},
+			expected:    false,
+		},
+		{
+			description:   "Unknown capability set",
+			spec:          sysAdminEverywhere,
+			policy:        PrivilegeConfig{CapabilitySets: []string{"foo"}},
+			expectedPanic: true,
+		},
+		{
+			description:   "No capability sets",
+			spec:          sysAdminEverywhere,
+			policy:        PrivilegeConfig{},
+			expectedPanic: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			spec := decodeSpec(strings.NewReader(tc.spec))
+
+			var decision privilegeDecision
+			decide := func() {
+				decision = getPrivilegeDecision(&tc.policy, spec)
+			}
+
+			if tc.expectedPanic {
+				mustPanic(t, decide)
+				return
+			}
+
+			decide()
+			if decision.Privileged != tc.expected {
+				t.Errorf("Unexpected decision (got: %v, wanted: %v, reasons: %v)", decision.Privileged, tc.expected, decision.Reasons)
+			}
+			if len(decision.Reasons) == 0 {
+				t.Errorf("Decision has no reasons")
+			}
+		})
+	}
+}
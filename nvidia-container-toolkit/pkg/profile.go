@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultProfileAnnotation = "nvidia.com/gpu-profile"
+)
+
+// ProfileConfig : settings for the containers selecting the profile through
+// the profile annotation.
+type ProfileConfig struct {
+	Capabilities   CapabilityPolicy `toml:"capabilities"`
+	DefaultDevices string           `toml:"default-devices"`
+}
+
+// PoolConfig : a named set of devices (indexes, UUIDs or MIG devices) and
+// the settings for the containers using them.
+type PoolConfig struct {
+	Devices      []string         `toml:"devices"`
+	Capabilities CapabilityPolicy `toml:"capabilities"`
+}
+
+// getProfile returns the profile selected by the container, if any. The
+// profile may be unknown, see checkProfile.
+func getProfile(hook *HookConfig, annotations map[string]string) string {
+	if len(hook.ProfileAnnotation) == 0 {
+		return ""
+	}
+	return annotations[hook.ProfileAnnotation]
+}
+
+// checkProfile rejects unknown profiles rather than ignoring them. Only GPU
+// containers are checked, profiles do not apply to other containers.
+func checkProfile(hook *HookConfig, profile string) {
+	if len(profile) == 0 {
+		return
+	}
+	if _, ok := hook.Profiles[profile]; !ok {
+		deny(deniedReasonProfile, fmt.Sprintf("unknown profile %q in annotation %s", profile, hook.ProfileAnnotation))
+	}
+}
+
+// A GPU or MIG device given by index.
+var deviceIndexPattern = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
+// getCanonicalDevice returns the index of the device, or <gpu index>:<mig
+// index> for a MIG device, through the inventory (when available). It returns
+// false if the device is given by UUID and the inventory does not know it.
+func getCanonicalDevice(inv *Inventory, device string) (string, bool) {
+	if inv != nil {
+		if canonical, ok := inv.getCanonicalDevice(device); ok {
+			return canonical, true
+		}
+	}
+	return device, deviceIndexPattern.MatchString(device)
+}
+
+// contains returns true if the canonical device, or the GPU of a MIG device,
+// is in the pool, whether the devices of the pool are given by index or UUID.
+func (p *PoolConfig) contains(inv *Inventory, device string) bool {
+	for _, d := range p.Devices {
+		d, _ = getCanonicalDevice(inv, d)
+		if d == device || strings.HasPrefix(device, d+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// getDevicePools returns the sorted names of the pools holding any of the
+// given devices. A container getting all the GPUs uses all the pools. Devices
+// are matched by index so that naming them by UUID does not escape a pool,
+// devices that cannot be matched are an error.
+func getDevicePools(pools map[string]PoolConfig, devices string, inv *Inventory) ([]string, error) {
+	if len(pools) == 0 {
+		return nil, nil
+	}
+	var canonical []string
+	for _, d := range splitDeviceList(devices) {
+		c, ok := getCanonicalDevice(inv, d)
+		if !ok && d != "all" {
+			return nil, fmt.Errorf("device %q is not in the inventory, cannot tell its pools", d)
+		}
+		canonical = append(canonical, c)
+	}
+
+	var names []string
+	for name, pool := range pools {
+		for _, d := range canonical {
+			if d == "all" || pool.contains(inv, d) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The constraints of the NVIDIA_REQUIRE_* variables, as understood by
+// nvidia-container-cli: comma-separated constraints are ANDed, space-separated
+// groups of them are ORed, and all the variables are ANDed.
+//
+//   NVIDIA_REQUIRE_CUDA="cuda>=11.0 brand=tesla,driver>=418,driver<419"
+
+const (
+	requirementCUDA   = "cuda"
+	requirementDriver = "driver"
+	requirementArch   = "arch"
+	requirementBrand  = "brand"
+)
+
+const (
+	requirementsOnFailureFail = "fail"
+	requirementsOnFailureWarn = "warn"
+)
+
+// RequirementsConfig : admin controls over the requirements. Enforce ignores
+// NVIDIA_DISABLE_REQUIRE, node requirements (e.g. "driver>=535") are added to
+// those of every GPU container and on-failure tells whether unsatisfied
+// requirements fail the container or are only logged.
+type RequirementsConfig struct {
+	Enforce   bool     `toml:"enforce"`
+	Node      []string `toml:"node"`
+	OnFailure string   `toml:"on-failure"`
+}
+
+var constraintPattern = regexp.MustCompile(`^(cuda|driver|arch|brand)(==|=|!=|<=|>=|<|>)(\S+)$`)
+
+type constraint struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+func (c constraint) String() string {
+	return c.Key + c.Operator + c.Value
+}
+
+// requirement is a disjunction of conjunctions of constraints.
+type requirement struct {
+	Raw    string
+	Groups [][]constraint
+}
+
+// The outcome of a check: host facts may not be known to the hook, in which
+// case the check is left to nvidia-container-cli.
+type checkResult int
+
+const (
+	checkSatisfied checkResult = iota
+	checkFailed
+	checkUnknown
+)
+
+func parseConstraint(s string) (constraint, error) {
+	m := constraintPattern.FindStringSubmatch(s)
+	if m == nil {
+		return constraint{}, fmt.Errorf("invalid constraint %q", s)
+	}
+	c := constraint{Key: m[1], Operator: m[2], Value: m[3]}
+	if c.Operator == "==" {
+		c.Operator = "="
+	}
+
+	if c.Key == requirementBrand {
+		if c.Operator != "=" && c.Operator != "!=" {
+			return constraint{}, fmt.Errorf("invalid operator in constraint %q", s)
+		}
+		return c, nil
+	}
+	if _, err := parseVersion(c.Value); err != nil {
+		return constraint{}, fmt.Errorf("invalid version in constraint %q", s)
+	}
+	return c, nil
+}
+
+func parseRequirement(s string) (requirement, error) {
+	r := requirement{Raw: s}
+	for _, group := range strings.Fields(s) {
+		var constraints []constraint
+		for _, c := range strings.Split(group, ",") {
+			if len(c) == 0 {
+				continue
+			}
+			parsed, err := parseConstraint(c)
+			if err != nil {
+				return requirement{}, err
+			}
+			constraints = append(constraints, parsed)
+		}
+		if len(constraints) > 0 {
+			r.Groups = append(r.Groups, constraints)
+		}
+	}
+	if len(r.Groups) == 0 {
+		return requirement{}, fmt.Errorf("empty requirement")
+	}
+	return r, nil
+}
+
+func parseVersion(s string) ([]int, error) {
+	var version []int
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		version = append(version, n)
+	}
+	return version, nil
+}
+
+// compareVersions compares dotted versions, missing components being zeros.
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (c constraint) evaluate(fact string) checkResult {
+	if len(fact) == 0 {
+		return checkUnknown
+	}
+
+	var cmp int
+	if c.Key == requirementBrand {
+		if !strings.EqualFold(fact, c.Value) {
+			cmp = 1
+		}
+	} else {
+		v, err := parseVersion(fact)
+		if err != nil {
+			return checkUnknown
+		}
+		// Validated when parsing.
+		w, _ := parseVersion(c.Value)
+		cmp = compareVersions(v, w)
+	}
+
+	var ok bool
+	switch c.Operator {
+	case "=":
+		ok = cmp == 0
+	case "!=":
+		ok = cmp != 0
+	case "<":
+		ok = cmp < 0
+	case "<=":
+		ok = cmp <= 0
+	case ">":
+		ok = cmp > 0
+	case ">=":
+		ok = cmp >= 0
+	}
+	if ok {
+		return checkSatisfied
+	}
+	return checkFailed
+}
+
+func (c constraint) getFact(facts *hostFacts, gpu *gpuFacts) (string, string) {
+	switch c.Key {
+	case requirementCUDA:
+		return facts.CUDAVersion, "host CUDA version"
+	case requirementDriver:
+		return facts.DriverVersion, "host driver version"
+	}
+	if gpu == nil {
+		return "", ""
+	}
+	if c.Key == requirementArch {
+		return gpu.Arch, fmt.Sprintf("GPU %d architecture", gpu.Index)
+	}
+	return gpu.Brand, fmt.Sprintf("GPU %d brand", gpu.Index)
+}
+
+// check evaluates the requirement for the given GPU, or without GPU facts if
+// gpu is nil. Failures come with the failed constraints and the facts
+// breaking them.
+func (r *requirement) check(facts *hostFacts, gpu *gpuFacts) (checkResult, []string) {
+	var reasons []string
+	result := checkFailed
+	for _, group := range r.Groups {
+		groupResult := checkSatisfied
+		for _, c := range group {
+			fact, name := c.getFact(facts, gpu)
+			switch c.evaluate(fact) {
+			case checkFailed:
+				groupResult = checkFailed
+				reasons = append(reasons, fmt.Sprintf("%s (%s is %s)", c, name, fact))
+			case checkUnknown:
+				if groupResult == checkSatisfied {
+					groupResult = checkUnknown
+				}
+			}
+			if groupResult == checkFailed {
+				break
+			}
+		}
+		if groupResult == checkSatisfied {
+			return checkSatisfied, nil
+		}
+		if groupResult == checkUnknown {
+			result = checkUnknown
+		}
+	}
+	if result == checkUnknown {
+		return checkUnknown, nil
+	}
+	return checkFailed, reasons
+}
+
+// getDeviceFacts returns the facts of the requested GPUs. GPUs without facts
+// are left out.
+func getDeviceFacts(facts *hostFacts, devices string) []gpuFacts {
+	var selected []gpuFacts
+	for _, gpu := range facts.GPUs {
+		for _, d := range splitDeviceList(devices) {
+			index := strconv.Itoa(gpu.Index)
+			if d == "all" || d == index || d == gpu.UUID || strings.HasPrefix(d, index+":") {
+				selected = append(selected, gpu)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// checkRequirements evaluates the requirements against the host facts, for
+// each of the requested GPUs. It returns an error describing the failed
+// constraints, and whether some of them could not be evaluated and must be
+// left to nvidia-container-cli.
+func checkRequirements(requirements []string, facts *hostFacts, devices string) (unknown bool, err error) {
+	gpus := getDeviceFacts(facts, devices)
+	for _, raw := range requirements {
+		r, err := parseRequirement(raw)
+		if err != nil {
+			return false, fmt.Errorf("invalid requirement %q: %v", raw, err)
+		}
+
+		var targets []*gpuFacts
+		for i := range gpus {
+			targets = append(targets, &gpus[i])
+		}
+		if len(targets) == 0 {
+			targets = append(targets, nil)
+		}
+		for _, gpu := range targets {
+			result, reasons := r.check(facts, gpu)
+			switch result {
+			case checkFailed:
+				return false, fmt.Errorf("unsatisfied requirement %q: %s", raw, strings.Join(reasons, ", "))
+			case checkUnknown:
+				unknown = true
+			}
+		}
+	}
+	return unknown, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRequirement(t *testing.T) {
+	r, err := parseRequirement("cuda>=11.0 brand=tesla,driver>=418,driver<419 arch==7.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]constraint{
+		{{"cuda", ">=", "11.0"}},
+		{{"brand", "=", "tesla"}, {"driver", ">=", "418"}, {"driver", "<", "419"}},
+		{{"arch", "=", "7.5"}},
+	}
+	if !reflect.DeepEqual(r.Groups, expected) {
+		t.Errorf("Unexpected groups: %v", r.Groups)
+	}
+
+	for _, invalid := range []string{"", "cuda", "foo>=1.0", "cuda>=x", "brand>tesla", "cuda=>11.0", "driver>=-1"} {
+		if _, err := parseRequirement(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCheckRequirements(t *testing.T) {
+	facts := hostFacts{
+		CUDAVersion:   "11.0",
+		DriverVersion: "450.80.02",
+		GPUs: []gpuFacts{
+			{Index: 0, UUID: "GPU-0", Arch: "7.0", Brand: "Tesla"},
+			{Index: 1, UUID: "GPU-1", Arch: "7.5", Brand: "GeForce"},
+		},
+	}
+
+	tests := []struct {
+		description     string
+		requirements    []string
+		facts           hostFacts
+		devices         string
+		expectedUnknown bool
+		expectedError   string
+	}{
+		{
+			description:  "Satisfied",
+			requirements: []string{"cuda>=10.2", "driver>=418.0,driver<=450.80.02"},
+			facts:        facts,
+			devices:      "0",
+		},
+		{
+			description:   "Failed CUDA requirement",
+			requirements:  []string{"cuda>=10.2", "cuda>=11.2"},
+			facts:         facts,
+			devices:       "0",
+			expectedError: `"cuda>=11.2": cuda>=11.2 (host CUDA version is 11.0)`,
+		},
+		{
+			description:  "Either group",
+			requirements: []string{"cuda>=11.2 brand=tesla,driver>=418"},
+			facts:        facts,
+			devices:      "0",
+		},
+		{
+			description:   "Per GPU facts",
+			requirements:  []string{"cuda>=11.2 brand=tesla,driver>=418"},
+			facts:         facts,
+			devices:       "0,1",
+			expectedError: `brand=tesla (GPU 1 brand is GeForce)`,
+		},
+		{
+			description:   "Architecture of all GPUs",
+			requirements:  []string{"arch>7.0"},
+			facts:         facts,
+			devices:       "all",
+			expectedError: `arch>7.0 (GPU 0 architecture is 7.0)`,
+		},
+		{
+			description:   "MIG device",
+			requirements:  []string{"arch!=7.5"},
+			facts:         facts,
+			devices:       "1:0",
+			expectedError: `arch!=7.5`,
+		},
+		{
+			description:     "Unknown facts",
+			requirements:    []string{"cuda>=11.0", "arch>=7.0"},
+			facts:           hostFacts{CUDAVersion: "11.0"},
+			devices:         "0",
+			expectedUnknown: true,
+		},
+		{
+			description:   "Failure despite unknown facts",
+			requirements:  []string{"arch>=7.0,cuda>=11.2"},
+			facts:         hostFacts{CUDAVersion: "11.0"},
+			devices:       "0",
+			expectedError: `cuda>=11.2`,
+		},
+		{
+			description:   "Invalid requirement",
+			requirements:  []string{"cuda>=11.0 foo=bar"},
+			facts:         facts,
+			devices:       "0",
+			expectedError: `invalid requirement`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			unknown, err := checkRequirements(tc.requirements, &tc.facts, tc.devices)
+			if len(tc.expectedError) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("Expected error containing %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unknown != tc.expectedUnknown {
+				t.Errorf("Expected unknown to be %v", tc.expectedUnknown)
+			}
+		})
+	}
+}
+
+func TestGetRequirementsOrder(t *testing.T) {
+	env := map[string]string{
+		envNVRequirePrefix + "B":    "driver>=418",
+		envNVRequirePrefix + "A":    "brand=tesla",
+		envNVRequireCUDA:            "cuda>=10.0",
+		envNVRequirePrefix + "ARCH": "arch>=7.0",
+	}
+	expected := []string{"brand=tesla", "arch>=7.0", "driver>=418", "cuda>=10.0"}
+	for i := 0; i < 10; i++ {
+		if r := getRequirements(env, false); !reflect.DeepEqual(r, expected) {
+			t.Fatalf("Unexpected requirements: %v", r)
+		}
+	}
+}
+
+func TestAdminRequirements(t *testing.T) {
+	env := map[string]string{
+		envNVVisibleDevices: "all",
+		envNVRequireCUDA:    "cuda>=11.0",
+		envNVDisableRequire: "true",
+	}
+
+	hook := getDefaultHookConfig()
+	config := getNvidiaConfig(&hook, env, nil, false)
+	if !config.DisableRequire {
+		t.Error("Expected NVIDIA_DISABLE_REQUIRE to be honored")
+	}
+
+	hook.Requirements.Enforce = true
+	hook.Requirements.Node = []string{"driver>=535"}
+	config = getNvidiaConfig(&hook, env, nil, false)
+	if config.DisableRequire {
+		t.Error("Expected NVIDIA_DISABLE_REQUIRE to be ignored")
+	}
+	expected := []string{"cuda>=11.0", "driver>=535"}
+	if !reflect.DeepEqual(config.Requirements, expected) {
+		t.Errorf("Unexpected requirements: %v", config.Requirements)
+	}
+
+	facts := hostFacts{DriverVersion: "470.82.01", CUDAVersion: "11.4"}
+	if _, err := checkRequirements(config.Requirements, &facts, config.Devices); err == nil || !strings.Contains(err.Error(), "driver>=535") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolveRootfs returns the absolute path of the container rootfs with all
+// symlinks evaluated. As mandated by the OCI runtime spec, a relative root
+// path is relative to the bundle directory, not to our working directory.
+//
+// The resolved path is refused if it is the host root, if it is not a
+// directory, if a relative root escapes the bundle (e.g. through '..' or a
+// symlink) or if it lies outside of the allowed prefixes (when set).
+func resolveRootfs(bundle string, root string, allowedPrefixes []string) (string, error) {
+	if len(root) == 0 {
+		return "", fmt.Errorf("root path is empty in OCI spec")
+	}
+
+	relative := !filepath.IsAbs(root)
+	if relative && len(bundle) == 0 {
+		return "", fmt.Errorf("cannot resolve relative root path %q without a bundle directory", root)
+	}
+
+	var resolvedBundle string
+	if relative {
+		b, err := filepath.Abs(bundle)
+		if err != nil {
+			return "", fmt.Errorf("couldn't get absolute bundle path: %v", err)
+		}
+		resolvedBundle, err = filepath.EvalSymlinks(b)
+		if err != nil {
+			return "", fmt.Errorf("couldn't resolve bundle path: %v", err)
+		}
+		root = filepath.Join(resolvedBundle, root)
+	}
+
+	rootfs, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve rootfs path: %v", err)
+	}
+
+	info, err := os.Stat(rootfs)
+	if err != nil {
+		return "", fmt.Errorf("couldn't stat rootfs: %v", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("rootfs %s is not a directory", rootfs)
+	}
+	if rootfs == "/" {
+		return "", fmt.Errorf("refusing to use the host root as container rootfs")
+	}
+
+	if relative && !isSubpath(resolvedBundle, rootfs) {
+		return "", fmt.Errorf("rootfs %s escapes bundle directory %s", rootfs, resolvedBundle)
+	}
+
+	if len(allowedPrefixes) == 0 {
+		return rootfs, nil
+	}
+	for _, prefix := range allowedPrefixes {
+		// The rootfs is resolved, so must be the prefixes (e.g. a symlinked
+		// /var/lib/docker). Missing prefixes are compared as they are.
+		prefix = filepath.Clean(prefix)
+		if resolved, err := filepath.EvalSymlinks(prefix); err == nil {
+			prefix = resolved
+		}
+		if isSubpath(prefix, rootfs) {
+			return rootfs, nil
+		}
+	}
+	return "", fmt.Errorf("rootfs %s is not under any of the allowed prefixes %v", rootfs, allowedPrefixes)
+}
+
+// isSubpath returns true if path is strictly below dir. Both paths are expected
+// to be clean and absolute.
+func isSubpath(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveRootfs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rootfs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	tmp, _ = filepath.EvalSymlinks(tmp)
+
+	// tmp/bundle/rootfs          directory
+	// tmp/bundle/link            -> rootfs
+	// tmp/bundle/escape          -> tmp/outside
+	// tmp/bundle/file            regular file
+	// tmp/outside                directory
+	// tmp/prefix                 -> bundle
+	bundle := filepath.Join(tmp, "bundle")
+	outside := filepath.Join(tmp, "outside")
+	for _, d := range []string{filepath.Join(bundle, "rootfs"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("rootfs", filepath.Join(bundle, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(bundle, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(bundle, filepath.Join(tmp, "prefix")); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		description     string
+		bundle          string
+		root            string
+		allowedPrefixes []string
+		expectedRootfs  string
+		expectedError   bool
+	}{
+		{
+			description:    "Relative root is resolved against the bundle",
+			bundle:         bundle,
+			root:           "rootfs",
+			expectedRootfs: filepath.Join(bundle, "rootfs"),
+		},
+		{
+			description:    "Absolute root",
+			bundle:         bundle,
+			root:           filepath.Join(bundle, "rootfs"),
+			expectedRootfs: filepath.Join(bundle, "rootfs"),
+		},
+		{
+			description:    "Symlink inside the bundle",
+			bundle:         bundle,
+			root:           "link",
+			expectedRootfs: filepath.Join(bundle, "rootfs"),
+		},
+		{
+			description:   "Symlink escaping the bundle",
+			bundle:        bundle,
+			root:          "escape",
+			expectedError: true,
+		},
+		{
+			description:   "Relative root escaping the bundle",
+			bundle:        bundle,
+			root:          "../outside",
+			expectedError: true,
+		},
+		{
+			description:   "Relative root without bundle",
+			root:          "rootfs",
+			expectedError: true,
+		},
+		{
+			description:   "Root is not a directory",
+			bundle:        bundle,
+			root:          "file",
+			expectedError: true,
+		},
+		{
+			description:   "Root does not exist",
+			bundle:        bundle,
+			root:          "missing",
+			expectedError: true,
+		},
+		{
+			description:   "Root is the host root",
+			bundle:        bundle,
+			root:          "/",
+			expectedError: true,
+		},
+		{
+			description:     "Root under an allowed prefix",
+			bundle:          bundle,
+			root:            "rootfs",
+			allowedPrefixes: []string{"/other", bundle},
+			expectedRootfs:  filepath.Join(bundle, "rootfs"),
+		},
+		{
+			description:     "Root under a symlinked allowed prefix",
+			bundle:          bundle,
+			root:            "rootfs",
+			allowedPrefixes: []string{filepath.Join(tmp, "prefix")},
+			expectedRootfs:  filepath.Join(bundle, "rootfs"),
+		},
+		{
+			description:     "Root outside of the allowed prefixes",
+			bundle:          bundle,
+			root:            outside,
+			allowedPrefixes: []string{bundle},
+			expectedError:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			rootfs, err := resolveRootfs(tc.bundle, tc.root, tc.allowedPrefixes)
+			if tc.expectedError {
+				if err == nil {
+					t.Errorf("Expected error, got rootfs %v", rootfs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rootfs != tc.expectedRootfs {
+				t.Errorf("Unexpected rootfs (got: %v, wanted: %v)", rootfs, tc.expectedRootfs)
+			}
+		})
+	}
+}
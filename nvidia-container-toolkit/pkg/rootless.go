@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	selfUIDMapPath = "/proc/self/uid_map"
+	nvidiactlPath  = "/dev/nvidiactl"
+)
+
+// userContext describes the user the hook runs as.
+type userContext struct {
+	Euid int
+	Egid int
+	// InUserNamespace is true when the hook runs in a non-initial user
+	// namespace, e.g. when invoked by rootless podman. The hook may then be
+	// uid 0 without having any privileges on the host.
+	InUserNamespace bool
+}
+
+func (u userContext) isRootless() bool {
+	return u.Euid != 0 || u.InUserNamespace
+}
+
+func getUserContext() userContext {
+	f, err := os.Open(selfUIDMapPath)
+	if err != nil {
+		log.Panicln("could not open uid map:", err)
+	}
+	defer f.Close()
+
+	return userContext{
+		Euid:            os.Geteuid(),
+		Egid:            os.Getegid(),
+		InUserNamespace: !isInitialUIDMap(f),
+	}
+}
+
+// isInitialUIDMap returns true if the given uid_map is the identity mapping
+// of the whole uid range, which is only the case in the initial namespace.
+func isInitialUIDMap(r io.Reader) bool {
+	var mappings []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+			mappings = append(mappings, line)
+		}
+	}
+	if len(mappings) != 1 {
+		return false
+	}
+
+	var containerID, hostID, size uint32
+	if _, err := fmt.Sscanf(mappings[0], "%d %d %d", &containerID, &hostID, &size); err != nil {
+		return false
+	}
+	return containerID == 0 && hostID == 0 && size == 4294967295
+}
+
+// mapToHost returns the host ID the given container ID is mapped to.
+func mapToHost(mappings []LinuxIDMapping, id uint32) (uint32, bool) {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id-m.ContainerID < m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// adjustCLIConfig returns a copy of the nvidia-container-cli configuration
+// adjusted for rootless hooks and user-namespaced containers.
+//
+// A rootless hook cannot set up device cgroups or load kernel modules, and
+// must not ask nvidia-container-cli to switch to a user it cannot become. For a
+// user-namespaced container, nvidia-container-cli runs as the host user that
+// the container root is mapped to, so that the files it creates in the rootfs
+// are owned by the container root.
+func adjustCLIConfig(cli CLIConfig, user userContext, container containerConfig) CLIConfig {
+	if user.isRootless() {
+		if !cli.NoCgroups {
+			log.Println("rootless hook: disabling device cgroups setup")
+			cli.NoCgroups = true
+		}
+		if cli.LoadKmods {
+			log.Println("rootless hook: disabling kernel modules loading")
+			cli.LoadKmods = false
+		}
+		if user.Euid != 0 {
+			current := fmt.Sprintf("%d:%d", user.Euid, user.Egid)
+			if cli.User != nil && *cli.User != current {
+				log.Panicf("rootless hook running as %s cannot run nvidia-container-cli as user %q: unset 'user' in the [nvidia-container-cli] section of the configuration", current, *cli.User)
+			}
+			cli.User = &current
+		}
+	}
+
+	if container.UserNamespace && cli.User == nil {
+		uid, uok := mapToHost(container.UIDMappings, 0)
+		gid, gok := mapToHost(container.GIDMappings, 0)
+		if uok && gok {
+			mapped := fmt.Sprintf("%d:%d", uid, gid)
+			log.Printf("user namespace: running nvidia-container-cli as %s\n", mapped)
+			cli.User = &mapped
+		}
+	}
+
+	return cli
+}
+
+// checkRootlessDeviceAccess makes sure that a rootless hook can use the
+// NVIDIA driver. Since kernel modules cannot be loaded and device nodes
+// cannot be created without privileges, both must be taken care of on the host.
+func checkRootlessDeviceAccess(path string) {
+	err := syscall.Access(path, 0x2|0x4) // W_OK|R_OK
+	if os.IsNotExist(err) {
+		log.Panicf("rootless hook: %s does not exist: load the NVIDIA kernel modules and create the device nodes on the host (e.g. with 'nvidia-modprobe -u -c=0' or by running 'nvidia-smi' as root)", path)
+	}
+	if err != nil {
+		log.Panicf("rootless hook: cannot access %s (%v): make sure the NVIDIA device nodes are readable and writable by the user running the container", path, err)
+	}
+}
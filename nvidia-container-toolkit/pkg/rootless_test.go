@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsInitialUIDMap(t *testing.T) {
+	var tests = []struct {
+		uidMap   string
+		expected bool
+	}{
+		{"         0          0 4294967295\n", true},
+		{"         0       1000          1\n         1     100000      65536\n", false},
+		{"         0     100000      65536\n", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		initial := isInitialUIDMap(strings.NewReader(tc.uidMap))
+		if initial != tc.expected {
+			t.Errorf("isInitialUIDMap(%q): %v (expected: %v)", tc.uidMap, initial, tc.expected)
+		}
+	}
+}
+
+func TestAdjustCLIConfig(t *testing.T) {
+	rootUser := "root:video"
+	userNamespace := containerConfig{
+		UserNamespace: true,
+		UIDMappings:   []LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings:   []LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+
+	var tests = []struct {
+		description   string
+		cli           CLIConfig
+		user          userContext
+		container     containerConfig
+		expected      CLIConfig
+		expectedPanic bool
+	}{
+		{
+			description: "Root hook, no user namespace",
+			cli:         CLIConfig{LoadKmods: true},
+			user:        userContext{},
+			expected:    CLIConfig{LoadKmods: true},
+		},
+		{
+			description: "Root hook in a user namespace (rootless podman)",
+			cli:         CLIConfig{LoadKmods: true},
+			user:        userContext{InUserNamespace: true},
+			expected:    CLIConfig{NoCgroups: true},
+		},
+		{
+			description: "Non-root hook",
+			cli:         CLIConfig{LoadKmods: true},
+			user:        userContext{Euid: 1000, Egid: 1000},
+			expected:    CLIConfig{NoCgroups: true, User: &[]string{"1000:1000"}[0]},
+		},
+		{
+			description:   "Non-root hook, user set to root",
+			cli:           CLIConfig{User: &rootUser},
+			user:          userContext{Euid: 1000, Egid: 1000},
+			expectedPanic: true,
+		},
+		{
+			description: "Root hook, user-namespaced container",
+			cli:         CLIConfig{LoadKmods: true},
+			user:        userContext{},
+			container:   userNamespace,
+			expected:    CLIConfig{LoadKmods: true, User: &[]string{"100000:200000"}[0]},
+		},
+		{
+			description: "Root hook, user-namespaced container, user set",
+			cli:         CLIConfig{User: &rootUser},
+			user:        userContext{},
+			container:   userNamespace,
+			expected:    CLIConfig{User: &rootUser},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			var cli CLIConfig
+			adjust := func() {
+				cli = adjustCLIConfig(tc.cli, tc.user, tc.container)
+			}
+
+			if tc.expectedPanic {
+				mustPanic(t, adjust)
+				return
+			}
+
+			adjust()
+			if !reflect.DeepEqual(cli, tc.expected) {
+				t.Errorf("Unexpected config (got: %+v, wanted: %+v)", cli, tc.expected)
+			}
+		})
+	}
+}
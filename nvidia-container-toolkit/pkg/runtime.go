@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	runtimeBinaryName = "nvidia-container-runtime"
+)
+
+// RuntimeConfig : options for the nvidia-container-runtime shim.
+type RuntimeConfig struct {
+	Debug     *string  `toml:"debug"`
+	Runtimes  []string `toml:"runtimes"`
+	HookPath  *string  `toml:"hook-path"`
+	HookStage string   `toml:"hook-stage"`
+	Mode      string   `toml:"mode"`
+}
+
+// runc global flags taking a value, which we need to skip to find the command.
+var runcGlobalFlagsWithValue = map[string]bool{
+	"log":        true,
+	"log-format": true,
+	"root":       true,
+	"criu":       true,
+	"rootless":   true,
+}
+
+// Name of the hook binaries whose presence in config.json means that GPUs
+// are already taken care of, e.g. by a podman hooks.d configuration.
+var nvidiaHookNames = []string{"nvidia-container-toolkit", "nvidia-container-runtime-hook"}
+
+// execRuntime replaces the current process with the low-level runtime.
+var execRuntime = syscall.Exec
+
+func trimFlag(arg string) (name string, value *string) {
+	name = strings.TrimLeft(arg, "-")
+	if p := strings.SplitN(name, "=", 2); len(p) == 2 {
+		return p[0], &p[1]
+	}
+	return name, nil
+}
+
+// getRuntimeCommand returns the runc command (e.g. 'create') and its bundle
+// directory, which defaults to the current directory as in runc.
+func getRuntimeCommand(args []string) (command string, bundle string) {
+	i := 0
+	for ; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			break
+		}
+		if name, value := trimFlag(args[i]); value == nil && runcGlobalFlagsWithValue[name] {
+			i++
+		}
+	}
+	if i == len(args) {
+		return "", ""
+	}
+	command = args[i]
+
+	for j := i + 1; j < len(args); j++ {
+		if !strings.HasPrefix(args[j], "-") {
+			continue
+		}
+		name, value := trimFlag(args[j])
+		if name != "b" && name != "bundle" {
+			continue
+		}
+		if value != nil {
+			return command, *value
+		}
+		if j+1 < len(args) {
+			return command, args[j+1]
+		}
+	}
+	return command, "."
+}
+
+// requestsGPUs returns true if the container asks for GPUs in any of the ways
+// understood by the hook. Whether it is allowed to get them is up to the hook.
+func requestsGPUs(hook *HookConfig, spec *Spec) bool {
+	envSwarmGPU = hook.SwarmResource
+	env := getEnvMap(spec.Process.Env)
+	if getDevicesFromEnvvar(env, getLegacyImageDevices(hook, env)) != nil {
+		return true
+	}
+	if usesDefaultDevices(hook, getProfile(hook, spec.Annotations), env, spec.Mounts) {
+		return true
+	}
+	return hook.AcceptDeviceListAsVolumeMounts && getDevicesFromMounts(spec.Mounts) != nil
+}
+
+func hasNvidiaHook(hooks []Hook) bool {
+	for _, h := range hooks {
+		for _, name := range nvidiaHookNames {
+			if filepath.Base(h.Path) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addNvidiaHooks adds the GPU injection hook to the spec, along with the
+// poststop hook releasing what it recorded and, if enabled, the poststart
+// verification hook. It returns false if the spec already has our hooks.
+func addNvidiaHooks(spec *Spec, hook *HookConfig, hookPath string, hookArgs []string) bool {
+	if spec.Hooks == nil {
+		spec.Hooks = &Hooks{}
+	}
+
+	injection := hook.NvidiaContainerRuntime.HookStage
+	if len(injection) == 0 {
+		injection = stagePrestart
+	}
+	if spec.Hooks.getStage(injection) == nil {
+		log.Panicln("unknown hook stage:", injection)
+	}
+	for _, stage := range []string{stagePrestart, stageCreateRuntime} {
+		if hasNvidiaHook(*spec.Hooks.getStage(stage)) {
+			return false
+		}
+	}
+
+	stages := []string{injection, stagePoststop}
+	if hook.Verify.Enabled {
+		stages = append(stages, stagePoststart)
+	}
+	for _, stage := range stages {
+		h := Hook{
+			Path: hookPath,
+			Args: append(append([]string{"nvidia-container-toolkit"}, hookArgs...), stage),
+			Env:  []string{"PATH=" + strings.Join(defaultPATH, ":")},
+		}
+		hooks := spec.Hooks.getStage(stage)
+		*hooks = append(*hooks, h)
+	}
+	return true
+}
+
+func findRuntime(candidates []string) string {
+	for _, r := range candidates {
+		if path, err := exec.LookPath(r); err == nil {
+			return path
+		}
+	}
+	log.Panicln("couldn't find any of the runtimes", candidates, "in", os.Getenv("PATH"))
+	return ""
+}
+
+func getHookPath(config RuntimeConfig) string {
+	if config.HookPath != nil {
+		return *config.HookPath
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Panicln("couldn't find the path of the hook:", err)
+	}
+	return self
+}
+
+// requestsDevices returns true if the container requests GPUs or CDI devices,
+// or if we cannot tell. The spec is not checked as when decoding it, so that
+// other containers run as they would without us even if we do not support
+// their spec (e.g. its OCI version).
+func requestsDevices(hook *HookConfig, specPath string) bool {
+	raw, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return true
+	}
+	var spec Spec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return true
+	}
+	if spec.Process == nil {
+		spec.Process = &Process{}
+	}
+	return requestsGPUs(hook, &spec) || len(getCDIDevicesFromAnnotations(spec.Annotations)) > 0
+}
+
+// modifyBundle applies the edits of the CDI devices requested by a container
+// and adds our hooks to its config.json or, in modify-spec mode, injects the
+// GPUs straight into it.
+func modifyBundle(hook *HookConfig, bundle string, hookArgs []string) {
+	specPath := path.Join(bundle, "config.json")
+	if !requestsDevices(hook, specPath) {
+		return
+	}
+
+	switch hook.NvidiaContainerRuntime.Mode {
+	case runtimeModeHook:
+	case runtimeModeModifySpec:
+		modifySpecFile(hook, hook.Inventory, specPath)
+		return
+	default:
+		log.Panicln("unknown runtime mode:", hook.NvidiaContainerRuntime.Mode)
+	}
+
+	spec, raw, err := readSpecFile(specPath)
+	if err != nil {
+		log.Panicln("could not read OCI spec:", err)
+	}
+	modified, err := injectCDIDevices(hook, spec)
+	if err != nil {
+		log.Panicln("could not inject CDI devices:", err)
+	}
+
+	if requestsGPUs(hook, spec) {
+		if addNvidiaHooks(spec, hook, getHookPath(hook.NvidiaContainerRuntime), hookArgs) {
+			modified = true
+		} else {
+			log.Println("GPU hooks already present in", specPath)
+		}
+	}
+	if !modified {
+		return
+	}
+	if err := writeSpecFile(specPath, raw, spec); err != nil {
+		log.Panicln("could not write OCI spec:", err)
+	}
+}
+
+// doRuntime wraps the low-level runtime. On 'create', the hooks are added to
+// the bundle config.json of GPU containers. All commands are then passed
+// through unchanged.
+func doRuntime(args []string) {
+	defer exit()
+	log.SetFlags(0)
+
+	hook := getHookConfig()
+	configureLogger(&hook.Log)
+	if debug := hook.NvidiaContainerRuntime.Debug; debug != nil {
+		f, err := os.OpenFile(*debug, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Panicln("could not open debug log:", err)
+		}
+		defer f.Close()
+		logger.addSink(writerSink{f})
+	}
+
+	var hookArgs []string
+	if len(*configflag) > 0 {
+		hookArgs = []string{"-config", *configflag}
+	}
+	err := runRuntime(&hook, args, hookArgs)
+	log.Panicln("exec failed:", err)
+}
+
+// runRuntime modifies the bundle if needed and execs the low-level runtime. It
+// only returns if the exec failed.
+func runRuntime(hook *HookConfig, args []string, hookArgs []string) error {
+	runtime := findRuntime(hook.NvidiaContainerRuntime.Runtimes)
+	if command, bundle := getRuntimeCommand(args); command == "create" {
+		modifyBundle(hook, bundle, hookArgs)
+	}
+	return execRuntime(runtime, append([]string{runtime}, args...), os.Environ())
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetRuntimeCommand(t *testing.T) {
+	var tests = []struct {
+		args            []string
+		expectedCommand string
+		expectedBundle  string
+	}{
+		{[]string{"--root", "/run/runc", "--log", "create", "create", "--bundle", "/run/bundle", "id"}, "create", "/run/bundle"},
+		{[]string{"--root=/run/runc", "create", "-b", "/run/bundle", "id"}, "create", "/run/bundle"},
+		{[]string{"--systemd-cgroup", "create", "--console-socket", "/tmp/sock", "--bundle=/run/bundle", "id"}, "create", "/run/bundle"},
+		{[]string{"create", "id"}, "create", "."},
+		{[]string{"start", "id"}, "start", "."},
+		{[]string{"--version"}, "", ""},
+	}
+	for _, tc := range tests {
+		command, bundle := getRuntimeCommand(tc.args)
+		if command != tc.expectedCommand || bundle != tc.expectedBundle {
+			t.Errorf("getRuntimeCommand(%v): %s, %s (expected: %s, %s)", tc.args, command, bundle, tc.expectedCommand, tc.expectedBundle)
+		}
+	}
+}
+
+func TestRunRuntime(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "runtime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The fake runtime records its arguments.
+	runtime := filepath.Join(tmp, "fake-runc")
+	argsFile := filepath.Join(tmp, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + argsFile + "\n"
+	if err := ioutil.WriteFile(runtime, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(e func(string, []string, []string) error) { execRuntime = e }(execRuntime)
+	execRuntime = func(argv0 string, argv []string, envv []string) error {
+		return exec.Command(argv0, argv[1:]...).Run()
+	}
+
+	hookPath := "/usr/bin/nvidia-container-toolkit"
+	hook := getDefaultHookConfig()
+	hook.NvidiaContainerRuntime.Runtimes = []string{"not-a-runtime", runtime}
+	hook.NvidiaContainerRuntime.HookPath = &hookPath
+
+	var tests = []struct {
+		description   string
+		spec          string
+		args          []string
+		expectedHooks *Hooks
+	}{
+		{
+			description: "GPU container is modified on create",
+			spec:        `{"ociVersion": "1.0.0", "process": {"args": ["sh"], "env": ["NVIDIA_VISIBLE_DEVICES=all"]}, "root": {"path": "rootfs"}}`,
+			args:        []string{"create", "--bundle", "BUNDLE", "id"},
+			expectedHooks: &Hooks{
+				Prestart: []Hook{{Path: hookPath, Args: []string{"nvidia-container-toolkit", "-config", "/etc/config.toml", "prestart"}, Env: []string{"PATH=" + strings.Join(defaultPATH, ":")}}},
+				Poststop: []Hook{{Path: hookPath, Args: []string{"nvidia-container-toolkit", "-config", "/etc/config.toml", "poststop"}, Env: []string{"PATH=" + strings.Join(defaultPATH, ":")}}},
+			},
+		},
+		{
+			description:   "Non-GPU container is not modified",
+			spec:          `{"ociVersion": "1.0.0", "process": {"args": ["sh"], "env": ["PATH=/bin"]}, "root": {"path": "rootfs"}}`,
+			args:          []string{"create", "--bundle", "BUNDLE", "id"},
+			expectedHooks: nil,
+		},
+		{
+			description:   "Non-GPU container with an unsupported spec is passed through",
+			spec:          `{"ociVersion": "0.5.0", "process": {"args": ["sh"], "env": ["PATH=/bin"]}, "root": {"path": "rootfs"}}`,
+			args:          []string{"create", "--bundle", "BUNDLE", "id"},
+			expectedHooks: nil,
+		},
+		{
+			description:   "GPU container with existing hook is not modified",
+			spec:          `{"ociVersion": "1.0.0", "process": {"env": ["NVIDIA_VISIBLE_DEVICES=0"]}, "root": {"path": "rootfs"}, "hooks": {"prestart": [{"path": "/usr/libexec/nvidia-container-runtime-hook"}]}}`,
+			args:          []string{"create", "--bundle", "BUNDLE", "id"},
+			expectedHooks: &Hooks{Prestart: []Hook{{Path: "/usr/libexec/nvidia-container-runtime-hook"}}},
+		},
+		{
+			description:   "Other commands are passed through",
+			spec:          `{"ociVersion": "1.0.0", "process": {"env": ["NVIDIA_VISIBLE_DEVICES=0"]}, "root": {"path": "rootfs"}}`,
+			args:          []string{"start", "id"},
+			expectedHooks: nil,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			bundle, err := ioutil.TempDir(tmp, "bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			specPath := filepath.Join(bundle, "config.json")
+			if err := ioutil.WriteFile(specPath, []byte(tc.spec), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var args []string
+			for _, a := range tc.args {
+				args = append(args, strings.Replace(a, "BUNDLE", bundle, -1))
+			}
+			if err := runRuntime(&hook, args, []string{"-config", "/etc/config.toml"}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			passed, err := ioutil.ReadFile(argsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(passed)) != strings.Join(args, " ") {
+				t.Errorf("Unexpected runtime arguments (got: %s, wanted: %v)", passed, args)
+			}
+
+			data, _ := ioutil.ReadFile(specPath)
+			var spec Spec
+			if err := json.Unmarshal(data, &spec); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(spec.Hooks, tc.expectedHooks) {
+				t.Errorf("Unexpected hooks (got: %+v, wanted: %+v)", spec.Hooks, tc.expectedHooks)
+			}
+
+			// process.args is not part of our Spec and must be preserved.
+			var doc struct {
+				Process struct {
+					Args []string `json:"args"`
+				} `json:"process"`
+			}
+			_ = json.Unmarshal(data, &doc)
+			if strings.Contains(tc.spec, `"args"`) && len(doc.Process.Args) == 0 {
+				t.Errorf("Unknown fields were not preserved: %s", data)
+			}
+			if !strings.Contains(tc.spec, `"user"`) && strings.Contains(string(data), `"user"`) {
+				t.Errorf("Unexpected process user: %s", data)
+			}
+		})
+	}
+}
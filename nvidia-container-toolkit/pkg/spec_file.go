@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Our Spec type only models what the toolkit reasons about. To edit a
+// config.json without losing everything else, the updated Spec is merged into
+// the original document: objects are merged recursively, anything else
+// (including arrays) is replaced. Fields can thus be added or changed, but not
+// removed.
+
+// readSpecFile returns the decoded spec along with the raw document.
+func readSpecFile(path string) (*Spec, []byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeSpec(bytes.NewReader(raw)), raw, nil
+}
+
+// writeSpecFile atomically replaces the spec file with the raw document
+// updated from spec.
+func writeSpecFile(path string, raw []byte, spec *Spec) error {
+	updated, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeJSON(raw, updated)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, merged, info.Mode())
+}
+
+// writeFileAtomic replaces the file with the given data, so that readers
+// never see a partial file.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func decodeJSONValue(data []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as they are, e.g. large memory limits or ID mappings.
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergeJSON merges the updated JSON document into the original one.
+func mergeJSON(original []byte, updated []byte) ([]byte, error) {
+	o, err := decodeJSONValue(original)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode original document: %v", err)
+	}
+	u, err := decodeJSONValue(updated)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode updated document: %v", err)
+	}
+	return json.Marshal(mergeJSONValues(o, u))
+}
+
+func mergeJSONValues(original interface{}, updated interface{}) interface{} {
+	o, ok := original.(map[string]interface{})
+	if !ok {
+		return updated
+	}
+	u, ok := updated.(map[string]interface{})
+	if !ok {
+		return updated
+	}
+	for k, v := range u {
+		o[k] = mergeJSONValues(o[k], v)
+	}
+	return o
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeJSON(t *testing.T) {
+	var tests = []struct {
+		description string
+		original    string
+		updated     string
+		expected    string
+	}{
+		{
+			description: "Unknown fields are kept",
+			original:    `{"ociVersion": "1.0.0", "process": {"args": ["sh"], "env": ["A=1"]}, "linux": {"resources": {"memory": {"limit": 9007199254740993}}}}`,
+			updated:     `{"ociVersion": "1.0.0", "process": {"env": ["A=1", "B=2"]}, "linux": {}}`,
+			expected:    `{"ociVersion": "1.0.0", "process": {"args": ["sh"], "env": ["A=1", "B=2"]}, "linux": {"resources": {"memory": {"limit": 9007199254740993}}}}`,
+		},
+		{
+			description: "New objects are added",
+			original:    `{"ociVersion": "1.0.0"}`,
+			updated:     `{"ociVersion": "1.0.0", "hooks": {"prestart": [{"path": "/bin/hook"}]}}`,
+			expected:    `{"ociVersion": "1.0.0", "hooks": {"prestart": [{"path": "/bin/hook"}]}}`,
+		},
+		{
+			description: "Arrays are replaced",
+			original:    `{"mounts": [{"destination": "/a"}, {"destination": "/b"}]}`,
+			updated:     `{"mounts": [{"destination": "/b"}]}`,
+			expected:    `{"mounts": [{"destination": "/b"}]}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			merged, err := mergeJSON([]byte(tc.original), []byte(tc.updated))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			got, _ := decodeJSONValue(merged)
+			expected, _ := decodeJSONValue([]byte(tc.expected))
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Unexpected document (got: %s, wanted: %s)", merged, tc.expected)
+			}
+		})
+	}
+
+	if _, err := mergeJSON([]byte(`{`), []byte(`{}`)); err == nil {
+		t.Errorf("Expected error on invalid document")
+	}
+}
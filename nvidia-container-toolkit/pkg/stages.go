@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/mod/semver"
+)
+
+// Hook stages from OCI runtime spec
+// https://github.com/opencontainers/runtime-spec/blob/v1.0.2/config.md#posix-platform-hooks
+const (
+	stagePrestart        = "prestart"
+	stageCreateRuntime   = "createRuntime"
+	stageCreateContainer = "createContainer"
+	stageStartContainer  = "startContainer"
+	stagePoststart       = "poststart"
+	stagePoststop        = "poststop"
+)
+
+// The createRuntime, createContainer and startContainer stages were added in
+// v1.0.2 of the runtime spec, which also deprecated prestart. Runtimes built
+// against the development branch of v1.0.2 (e.g. runc 1.0.0-rc93) already
+// support them and report 1.0.2-dev.
+const newHookStagesVersion = "v1.0.2-dev"
+
+// supportsNewHookStages returns true if a runtime implementing the given
+// version of the runtime spec runs the createRuntime family of hooks.
+func supportsNewHookStages(ociVersion string) bool {
+	v := "v" + ociVersion
+	return semver.IsValid(v) && semver.Compare(v, newHookStagesVersion) >= 0
+}
+
+// getInjectionStage returns the stage GPUs should be injected in for a runtime
+// implementing the given version of the runtime spec.
+func getInjectionStage(ociVersion string) string {
+	if supportsNewHookStages(ociVersion) {
+		return stageCreateRuntime
+	}
+	return stagePrestart
+}
+
+// checkHookStage returns an error if the hook cannot run in the given stage.
+// startContainer hooks run inside the container, after pivot_root, where
+// neither the configuration nor the state of the hook are visible.
+func checkHookStage(stage string) error {
+	if stage == stageStartContainer {
+		return fmt.Errorf("%s hooks run inside the container, where the hook configuration and state are not visible: use %s or %s", stage, stageCreateContainer, stagePoststart)
+	}
+	return nil
+}
+
+// getStage returns the list of hooks run at the given stage, or nil for an
+// unknown stage.
+func (h *Hooks) getStage(stage string) *[]Hook {
+	switch stage {
+	case stagePrestart:
+		return &h.Prestart
+	case stageCreateRuntime:
+		return &h.CreateRuntime
+	case stageCreateContainer:
+		return &h.CreateContainer
+	case stageStartContainer:
+		return &h.StartContainer
+	case stagePoststart:
+		return &h.Poststart
+	case stagePoststop:
+		return &h.Poststop
+	}
+	return nil
+}
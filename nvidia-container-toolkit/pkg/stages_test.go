@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetInjectionStage(t *testing.T) {
+	var tests = []struct {
+		version  string
+		expected string
+	}{
+		{"1.0.0", stagePrestart},
+		{"1.0.1-dev", stagePrestart},
+		{"1.0.2-dev", stageCreateRuntime},
+		{"1.0.2", stageCreateRuntime},
+		{"1.2.0", stageCreateRuntime},
+		{"foo", stagePrestart},
+	}
+	for _, tc := range tests {
+		stage := getInjectionStage(tc.version)
+		if stage != tc.expected {
+			t.Errorf("getInjectionStage(%s): %s (expected: %s)", tc.version, stage, tc.expected)
+		}
+	}
+}
+
+func TestCheckHookStage(t *testing.T) {
+	for _, stage := range []string{stagePrestart, stageCreateRuntime, stageCreateContainer, stagePoststart, stagePoststop} {
+		if err := checkHookStage(stage); err != nil {
+			t.Errorf("Unexpected error for %s: %v", stage, err)
+		}
+	}
+	if err := checkHookStage(stageStartContainer); err == nil {
+		t.Errorf("Expected an error for %s", stageStartContainer)
+	}
+}
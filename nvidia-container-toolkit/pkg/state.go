@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+const (
+	defaultStateDir = "/run/nvidia-container-toolkit"
+)
+
+var validContainerID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// containerRecord is what the prestart hook records about a GPU container, so
+// that the later stages know what to verify and what to clean up.
+type containerRecord struct {
+	ID                 string    `json:"id"`
+	Bundle             string    `json:"bundle"`
+	Pid                int       `json:"pid"`
+	Devices            string    `json:"devices"`
+	DriverCapabilities string    `json:"driverCapabilities"`
+	Created            time.Time `json:"created"`
+	// Leases are the lease files held by the container.
+	Leases []string `json:"leases,omitempty"`
+	// Files are per-container files (e.g. debug logs, temporary files)
+	// to remove once the container is gone.
+	Files []string `json:"files,omitempty"`
+}
+
+func getRecordPath(stateDir string, id string) string {
+	return filepath.Join(stateDir, "containers", id+".json")
+}
+
+// canRecord returns an error if we cannot keep state for the given container.
+func canRecord(stateDir string, id string) error {
+	if len(stateDir) == 0 {
+		return fmt.Errorf("no state directory configured")
+	}
+	if !validContainerID.MatchString(id) {
+		return fmt.Errorf("invalid container ID %q", id)
+	}
+	return nil
+}
+
+// saveContainerRecord atomically writes the record of a container.
+func saveContainerRecord(stateDir string, record *containerRecord) error {
+	path := getRecordPath(stateDir, record.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+record.ID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadContainerRecord returns the record of a container, or nil if none exists.
+func loadContainerRecord(stateDir string, id string) (*containerRecord, error) {
+	data, err := ioutil.ReadFile(getRecordPath(stateDir, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var record containerRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("could not decode container record: %v", err)
+	}
+	return &record, nil
+}
+
+// recordContainer acquires the device leases of a GPU container and records
+// them along with its per-container files, so that the poststop hook can
+// release them and close its assignment in the audit log. Containers given
+// CDI devices through annotations lease the GPUs they name. Failing to acquire
+// the leases is only logged, the error returned is about the record itself.
+func recordContainer(hook *HookConfig, container *containerConfig, files []string) error {
+	if err := canRecord(hook.StateDir, container.ID); err != nil {
+		return err
+	}
+
+	assignment := getAssignmentRecord(container)
+	record := &containerRecord{
+		ID:                 container.ID,
+		Bundle:             container.Bundle,
+		Pid:                container.Pid,
+		Devices:            assignment.Devices,
+		DriverCapabilities: assignment.Capabilities,
+		Created:            time.Now().UTC(),
+		Files:              files,
+	}
+	devices := assignment.Devices
+	if container.Nvidia == nil {
+		devices = getCDIGPUDevices(container.CDIDevices)
+	}
+
+	lock, err := lockLeases(hook.StateDir)
+	if err == nil {
+		record.Leases, err = acquireLeases(hook.StateDir, container.ID, splitDeviceList(devices))
+		lock.Close()
+	}
+	if err != nil {
+		log.Println("could not acquire device leases:", err)
+	}
+
+	return saveContainerRecord(hook.StateDir, record)
+}
+
+// recordAssignment records a container whose assignment is about to be
+// audited. The poststop hook closes the assignment from the record, so with an
+// audit log the container is refused if it cannot be recorded. Otherwise
+// failing to keep state must not prevent the container from starting.
+func recordAssignment(hook *HookConfig, container *containerConfig, files []string) {
+	err := recordContainer(hook, container, files)
+	if err == nil {
+		return
+	}
+	if len(hook.Audit.Path) > 0 {
+		log.Panicln("could not record the container for the audit log:", err)
+	}
+	log.Println("not recording container state:", err)
+}
+
+// releaseContainer removes everything recorded for a container. The record
+// itself is removed last, so that a failed cleanup can be retried, and it is
+// safe to call when nothing was recorded.
+func releaseContainer(hook *HookConfig, id string) error {
+	if err := canRecord(hook.StateDir, id); err != nil {
+		log.Println("no container state to release:", err)
+		return nil
+	}
+
+	record, err := loadContainerRecord(hook.StateDir, id)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return nil
+	}
+
+	if err := releaseLeases(hook.StateDir, record.Leases); err != nil {
+		return err
+	}
+	for _, path := range record.Files {
+		if err := removeIfExists(path); err != nil {
+			return err
+		}
+	}
+
+	writeAuditRecord(hook.Audit, auditRecord{
+		Event:        auditEventReleased,
+		ContainerID:  record.ID,
+		Bundle:       record.Bundle,
+		Devices:      record.Devices,
+		Capabilities: record.DriverCapabilities,
+	})
+
+	return removeIfExists(getRecordPath(hook.StateDir, id))
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReleaseContainer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hook := getDefaultHookConfig()
+	hook.StateDir = filepath.Join(tmp, "state")
+	hook.Audit.Path = filepath.Join(tmp, "audit.jsonl")
+
+	debugLog := filepath.Join(tmp, "debug-abcd.log")
+	if err := ioutil.WriteFile(debugLog, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	container := containerConfig{
+		ID:     "abcd",
+		Bundle: "/run/bundle",
+		Nvidia: &nvidiaConfig{
+			Devices:            "GPU0,GPU1-MIG0/0/1",
+			DriverCapabilities: "compute,utility",
+		},
+	}
+	if err := recordContainer(&hook, &container, []string{debugLog}); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := loadContainerRecord(hook.StateDir, "abcd")
+	if err != nil || record == nil {
+		t.Fatalf("Container record not found (error: %v)", err)
+	}
+	if len(record.Leases) != 2 {
+		t.Fatalf("Unexpected leases: %v", record.Leases)
+	}
+	for _, lease := range record.Leases {
+		if _, err := os.Stat(lease); err != nil {
+			t.Errorf("Lease %v not created: %v", lease, err)
+		}
+	}
+
+	// Releasing twice must be a no-op the second time.
+	for i := 0; i < 2; i++ {
+		if err := releaseContainer(&hook, "abcd"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	for _, path := range append(record.Leases, debugLog, getRecordPath(hook.StateDir, "abcd")) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("File %v not removed", path)
+		}
+	}
+	devices, err := ioutil.ReadDir(filepath.Join(hook.StateDir, "leases"))
+	if err != nil || len(devices) != 0 {
+		t.Errorf("Lease directories not removed (got: %v, error: %v)", devices, err)
+	}
+
+	audit, err := ioutil.ReadFile(hook.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Unexpected audit log: %v", lines)
+	}
+	var entry auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := auditRecord{Time: entry.Time, Event: auditEventReleased, ContainerID: "abcd", Bundle: "/run/bundle", Devices: "GPU0,GPU1-MIG0/0/1", Capabilities: "compute,utility"}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Unexpected audit record (got: %+v, wanted: %+v)", entry, expected)
+	}
+}
+
+func TestReleaseUnknownContainer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hook := getDefaultHookConfig()
+	hook.StateDir = tmp
+
+	for _, id := range []string{"never-started", "", "../escape"} {
+		if err := releaseContainer(&hook, id); err != nil {
+			t.Errorf("releaseContainer(%q): unexpected error: %v", id, err)
+		}
+	}
+}
+
+func TestRecordCDIContainer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hook := getDefaultHookConfig()
+	hook.StateDir = filepath.Join(tmp, "state")
+	hook.Audit.Path = filepath.Join(tmp, "audit.jsonl")
+
+	// Containers given CDI devices through annotations hold the GPUs they
+	// name, and their assignment is closed on release.
+	container := containerConfig{
+		ID:           "abcd",
+		Bundle:       "/run/bundle",
+		CDIDevices:   []string{"nvidia.com/gpu=0", "vendor.com/device=foo"},
+		DeviceSource: deviceSourceAnnotation,
+	}
+	recordAssignment(&hook, &container, nil)
+	if leased, err := isLeased(hook.StateDir, nil, "0"); err != nil || !leased {
+		t.Errorf("Device not leased (leased: %v, error: %v)", leased, err)
+	}
+	if err := releaseContainer(&hook, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := ioutil.ReadFile(hook.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry auditRecord
+	if err := json.Unmarshal(audit, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Event != auditEventReleased || entry.Devices != "nvidia.com/gpu=0,vendor.com/device=foo" {
+		t.Errorf("Unexpected audit record: %+v", entry)
+	}
+
+	// An audited assignment that could not be closed is refused.
+	container.ID = "../escape"
+	mustPanic(t, func() {
+		recordAssignment(&hook, &container, nil)
+	})
+	hook.Audit.Path = ""
+	recordAssignment(&hook, &container, nil)
+}
+
+func TestReleaseSharedDevice(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	hook := getDefaultHookConfig()
+	hook.StateDir = tmp
+	hook.Audit.Path = ""
+
+	for _, id := range []string{"abcd", "efgh"} {
+		container := containerConfig{ID: id, Nvidia: &nvidiaConfig{Devices: "0"}}
+		if err := recordContainer(&hook, &container, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := releaseContainer(&hook, "abcd"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if leased, err := isLeased(hook.StateDir, nil, "0"); err != nil || !leased {
+		t.Errorf("Device released while still held (leased: %v, error: %v)", leased, err)
+	}
+
+	if err := releaseContainer(&hook, "efgh"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(getLeaseDir(hook.StateDir, "0")); !os.IsNotExist(err) {
+		t.Errorf("Lease directory not removed (error: %v)", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	verifyOnFailureFail  = "fail"
+	verifyOnFailureWarn  = "warn"
+	verifyOnFailureAudit = "audit"
+)
+
+// VerifyConfig : options for checking that GPUs were actually injected.
+type VerifyConfig struct {
+	Enabled   bool   `toml:"enabled"`
+	OnFailure string `toml:"on-failure"`
+}
+
+// Library directories of the common distributions, relative to the container
+// root. We avoid /lib and friends as they often are absolute symlinks, which
+// would be resolved against the host root when inspecting /proc/<pid>/root.
+var containerLibraryDirs = []string{
+	"usr/lib64",
+	"usr/lib/x86_64-linux-gnu",
+	"usr/lib/aarch64-linux-gnu",
+	"usr/lib/powerpc64le-linux-gnu",
+	"usr/lib",
+}
+
+// getInjectedPath returns where a host file of the driver is injected in the
+// container, files under the driver root being injected without its prefix.
+func getInjectedPath(driverRoot string, path string) string {
+	if rel, err := filepath.Rel(driverRoot, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.Join("/", rel)
+	}
+	return path
+}
+
+// verifyInjection looks for the device nodes, driver files and libraries that
+// should have been injected in the container mounted at root, and returns a
+// description of everything that is missing. What each capability injects
+// comes from the registry, the driver files of which live under driverRoot on
+// the host.
+func verifyInjection(root string, record *containerRecord, registry capabilityRegistry, driverRoot string) []string {
+	var missing []string
+
+	expectDevice := func(pattern string) {
+		matches, _ := filepath.Glob(filepath.Join(root, pattern))
+		if len(matches) == 0 {
+			missing = append(missing, fmt.Sprintf("device node %s", pattern))
+		}
+	}
+
+	expectDevice("/dev/nvidiactl")
+	if len(splitDeviceList(record.Devices)) > 0 {
+		expectDevice("/dev/nvidia[0-9]*")
+	}
+
+	for _, name := range strings.Split(record.DriverCapabilities, ",") {
+		if name == "compute" {
+			expectDevice("/dev/nvidia-uvm")
+		}
+		c, _ := registry.lookup(name)
+		if c == nil {
+			continue
+		}
+		for _, path := range c.Devices {
+			if _, err := os.Lstat(filepath.Join(root, getInjectedPath(driverRoot, path))); err != nil {
+				missing = append(missing, fmt.Sprintf("%s device node %s", c.Name, path))
+			}
+		}
+		for _, path := range c.Files {
+			if _, err := os.Lstat(filepath.Join(root, getInjectedPath(driverRoot, path))); err != nil {
+				missing = append(missing, fmt.Sprintf("%s file %s", c.Name, path))
+			}
+		}
+		for _, lib := range c.Libraries {
+			if !hasLibrary(root, lib) {
+				missing = append(missing, fmt.Sprintf("%s library %s", c.Name, lib))
+			}
+		}
+	}
+
+	return missing
+}
+
+func hasLibrary(root string, lib string) bool {
+	for _, dir := range containerLibraryDirs {
+		matches, _ := filepath.Glob(filepath.Join(root, dir, lib+"*"))
+		if len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyContainer checks the GPU injection of a container seen at root and
+// applies the failure policy. Failing a hook after the container
+// has started does not stop it, so the "fail" policy kills the container
+// process when pid is set.
+func verifyContainer(hook *HookConfig, id string, root string, pid int) {
+	if err := canRecord(hook.StateDir, id); err != nil {
+		log.Println("cannot verify GPU injection:", err)
+		return
+	}
+
+	record, err := loadContainerRecord(hook.StateDir, id)
+	if err != nil {
+		log.Panicln("could not load container state:", err)
+	}
+	if record == nil {
+		// Not a GPU container, nothing to verify.
+		return
+	}
+
+	missing := verifyInjection(root, record, getCapabilityRegistry(&hook.DriverCapabilities), getDriverRoot(hook))
+	if len(missing) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("incomplete GPU injection, missing: %s", strings.Join(missing, ", "))
+
+	switch hook.Verify.OnFailure {
+	case verifyOnFailureWarn:
+		logWarn(msg)
+	case verifyOnFailureAudit:
+		writeAuditRecord(hook.Audit, auditRecord{
+			Event:       auditEventVerifyFailed,
+			ContainerID: record.ID,
+			Bundle:      record.Bundle,
+			Devices:     record.Devices,
+			Reason:      msg,
+		})
+	case verifyOnFailureFail:
+		if pid > 0 {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+				log.Println("could not kill container process:", err)
+			}
+		}
+		log.Panicln(msg)
+	default:
+		log.Panicln("unknown verification failure policy:", hook.Verify.OnFailure)
+	}
+}
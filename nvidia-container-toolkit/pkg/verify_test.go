@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyInjection(t *testing.T) {
+	root, err := ioutil.TempDir("", "verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, f := range []string{
+		"dev/nvidiactl",
+		"dev/nvidia-uvm",
+		"dev/nvidia0",
+		"usr/lib/x86_64-linux-gnu/libcuda.so.450.51.06",
+		"usr/lib/x86_64-linux-gnu/libnvidia-ml.so.450.51.06",
+		"usr/lib/x86_64-linux-gnu/libnvidia-fabric.so.1",
+	} {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Custom capabilities are checked too, their driver files being injected
+	// without the driver root prefix.
+	driverRoot := "/run/nvidia/driver"
+	registry := getCapabilityRegistry(&CapabilityConfig{Registry: []DriverCapability{
+		{Name: "fabric", Flag: "--fabric", Files: []string{driverRoot + "/usr/lib/x86_64-linux-gnu/libnvidia-fabric.so.1"}},
+		{Name: "imex", Flag: "--imex", Devices: []string{"/dev/nvidia-caps-imex-channels/channel0"}},
+	}})
+
+	var tests = []struct {
+		description     string
+		record          containerRecord
+		expectedMissing []string
+	}{
+		{
+			description: "Everything injected",
+			record:      containerRecord{Devices: "0", DriverCapabilities: "compute,utility"},
+		},
+		{
+			description: "No devices",
+			record:      containerRecord{Devices: "", DriverCapabilities: "utility"},
+		},
+		{
+			description:     "Missing video library",
+			record:          containerRecord{Devices: "0", DriverCapabilities: "utility,video"},
+			expectedMissing: []string{"video library libnvcuvid.so"},
+		},
+		{
+			description: "Capabilities without library checks",
+			record:      containerRecord{Devices: "all", DriverCapabilities: "compat32,display"},
+		},
+		{
+			description: "Custom capability",
+			record:      containerRecord{Devices: "0", DriverCapabilities: "utility,fabric"},
+		},
+		{
+			description:     "Missing device of a custom capability",
+			record:          containerRecord{Devices: "0", DriverCapabilities: "imex"},
+			expectedMissing: []string{"imex device node /dev/nvidia-caps-imex-channels/channel0"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			missing := verifyInjection(root, &tc.record, registry, driverRoot)
+			if !reflect.DeepEqual(missing, tc.expectedMissing) {
+				t.Errorf("Unexpected missing items (got: %v, wanted: %v)", missing, tc.expectedMissing)
+			}
+		})
+	}
+
+	missing := verifyInjection(filepath.Join(root, "empty"), &containerRecord{Devices: "0", DriverCapabilities: "compute,fabric"}, registry, driverRoot)
+	expected := []string{"device node /dev/nvidiactl", "device node /dev/nvidia[0-9]*", "device node /dev/nvidia-uvm", "compute library libcuda.so", "fabric file " + driverRoot + "/usr/lib/x86_64-linux-gnu/libnvidia-fabric.so.1"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("Unexpected missing items (got: %v, wanted: %v)", missing, expected)
+	}
+}